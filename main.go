@@ -2,13 +2,18 @@ package main
 
 import (
 	"bufio"
+	"bytes"
+	"compress/gzip"
 	"encoding/binary"
+	"flag"
 	"fmt"
+	"io"
+	"math"
 	"os"
+	"path/filepath"
 	"strconv"
 	"strings"
-	"syscall"
-	"unsafe"
+	"time"
 )
 
 const INVALID_PAGE_NUM = uint32(0xFFFFFFFF)
@@ -27,7 +32,10 @@ const (
 	PREPARE_UNRECOGNISED_COMMAND
 	PREPARE_SYNTAX_ERROR
 	PREPARE_NEGATIVE_ID
-	PREPARE_SYNTAX_TOO_LONG
+	PREPARE_TOO_MANY_VALUES
+	PREPARE_STRING_TOO_LONG
+	PREPARE_NULL_ID
+	PREPARE_STAR_WITH_COLUMNS
 )
 
 type ExecuteResult int
@@ -36,18 +44,112 @@ const (
 	EXECUTE_SUCCESS ExecuteResult = iota
 	EXECUTE_TABLE_FULL
 	EXECUTE_DUPLICATE_KEY
+	EXECUTE_KEY_NOT_FOUND
 )
 
+type OutputMode int
+
+const (
+	OUTPUT_MODE_LIST OutputMode = iota
+	OUTPUT_MODE_INSERT
+)
+
+// NulDisplay controls how list output renders NUL and other non-printable
+// bytes inside text values.
+type NulDisplay int
+
+const (
+	NUL_DISPLAY_TRIMMED NulDisplay = iota // end the value at its first NUL
+	NUL_DISPLAY_RAW                       // write the bytes unchanged
+	NUL_DISPLAY_ESCAPED                   // write non-printable bytes as \xNN
+)
+
+// DuplicatePolicy decides what an insert does when its id already exists.
+type DuplicatePolicy int
+
+const (
+	DUPLICATE_ERROR DuplicatePolicy = iota
+	DUPLICATE_IGNORE
+	DUPLICATE_REPLACE
+)
+
+func parseDuplicatePolicy(name string) (DuplicatePolicy, error) {
+	switch name {
+	case "error":
+		return DUPLICATE_ERROR, nil
+	case "ignore":
+		return DUPLICATE_IGNORE, nil
+	case "replace":
+		return DUPLICATE_REPLACE, nil
+	}
+	return DUPLICATE_ERROR, fmt.Errorf("unknown duplicate key policy: %s", name)
+}
+
 type StatementType int
 
 const (
 	STATEMENT_INSERT StatementType = iota
 	STATEMENT_SELECT
+	STATEMENT_SELECT_CONSTANT
+	STATEMENT_EXPLAIN_INSERT
+	STATEMENT_DELETE
+	STATEMENT_UPDATE
+)
+
+type WhereOperator int
+
+const (
+	WHERE_NONE WhereOperator = iota
+	WHERE_GREATER
+	WHERE_GREATER_EQUAL
+	WHERE_NOT_EQUAL
+	WHERE_EQUAL
+	WHERE_BETWEEN
+)
+
+// WhereClause is a predicate on the id column, the only one that can be
+// answered from the B-tree key.
+type WhereClause struct {
+	operator WhereOperator
+	key      uint32
+	// Inclusive upper bound for WHERE_BETWEEN, whose lower bound is key.
+	high uint32
+}
+
+type Column int
+
+const (
+	COLUMN_ID Column = iota
+	COLUMN_USERNAME
+	COLUMN_EMAIL
 )
 
+var columnNames = []string{"id", "username", "email"}
+
+func lookupColumn(name string) (Column, bool) {
+	for i, columnName := range columnNames {
+		if columnName == name {
+			return Column(i), true
+		}
+	}
+	return 0, false
+}
+
 type Statement struct {
 	typ         StatementType
 	rowToInsert Row
+	where       WhereClause
+	// columns is the select projection; nil means every column.
+	columns []Column
+	// limit caps the rows a select returns when hasLimit is set.
+	hasLimit bool
+	limit    uint32
+	// descending returns rows from the highest id down ("order by id desc").
+	descending bool
+	// constant is the value of a table-less select such as "select 1 + 2".
+	constant string
+	// key is the id a delete removes.
+	key uint32
 }
 
 const (
@@ -80,17 +182,19 @@ type Cursor struct {
 	pageNum    uint32
 	cellNum    uint32
 	endOfTable bool
+	// Leaves entered so far, so a next-leaf pointer that loops back is
+	// reported instead of scanned forever. Created on the first hop.
+	visited map[uint32]bool
 }
 
 type Nodetype uint8
 
 func getNodeType(node []byte) Nodetype {
-	value := *(*uint)(unsafe.Pointer(&node[NODE_TYPE_OFFSET]))
-	return Nodetype(value)
+	return Nodetype(node[NODE_TYPE_OFFSET])
 }
 
 func setNodeType(node []byte, typ Nodetype) {
-	*(*uint8)(unsafe.Pointer(&node[NODE_TYPE_OFFSET])) = uint8(typ)
+	node[NODE_TYPE_OFFSET] = uint8(typ)
 }
 
 const (
@@ -109,41 +213,57 @@ const (
 	LEAF_NODE_NUM_CELLS_SIZE   = 4
 	LEAF_NODE_NUM_CELLS_OFFSET = COMMON_NODE_HEADER_SIZE
 	LEAF_NODE_NEXT_LEAF_SIZE   = 4
-	LEAF_NODE_NEXT_LEAF_OFFSET = LEAF_NODE_NUM_CELLS_OFFSET + LEAF_NODE_NEXT_LEAF_SIZE
-	LEAF_NODE_HEADER_SIZE      = COMMON_NODE_HEADER_SIZE + LEAF_NODE_NUM_CELLS_SIZE
+	LEAF_NODE_NEXT_LEAF_OFFSET = LEAF_NODE_NUM_CELLS_OFFSET + LEAF_NODE_NUM_CELLS_SIZE
+	LEAF_NODE_HEADER_SIZE      = COMMON_NODE_HEADER_SIZE + LEAF_NODE_NUM_CELLS_SIZE + LEAF_NODE_NEXT_LEAF_SIZE
 	LEAF_NODE_KEY_SIZE         = 4
 	LEAF_NODE_KEY_OFFSET       = 0
 	LEAF_NODE_VALUE_OFFSET     = LEAF_NODE_KEY_OFFSET + LEAF_NODE_KEY_SIZE
 )
 
 var (
-	LEAF_NODE_VALUE_SIZE        = ROW_SIZE
-	LEAF_NODE_CELL_SIZE         = LEAF_NODE_KEY_SIZE + LEAF_NODE_VALUE_SIZE
-	LEAF_NODE_SPACE_FOR_CELLS   = PAGE_SIZE - LEAF_NODE_HEADER_SIZE
-	LEAF_NODE_MAX_CELLS         = LEAF_NODE_SPACE_FOR_CELLS / LEAF_NODE_CELL_SIZE
-	LEAF_NODE_RIGHT_SPLIT_COUNT = (LEAF_NODE_MAX_CELLS + 1) / 2
-	LEAF_NODE_LEFT_SPLIT_COUNT  = LEAF_NODE_MAX_CELLS + 1 - LEAF_NODE_RIGHT_SPLIT_COUNT
+	LEAF_NODE_VALUE_SIZE      = ROW_SIZE
+	LEAF_NODE_CELL_SIZE       = LEAF_NODE_KEY_SIZE + LEAF_NODE_VALUE_SIZE
+	LEAF_NODE_SPACE_FOR_CELLS = PAGE_SIZE - LEAF_NODE_HEADER_SIZE
+	LEAF_NODE_MAX_CELLS       = LEAF_NODE_SPACE_FOR_CELLS / LEAF_NODE_CELL_SIZE
 )
 
-func leafNodeNumcells(node []byte) *uint32 {
-	return (*uint32)(unsafe.Pointer(&node[LEAF_NODE_NUM_CELLS_OFFSET]))
+func leafNodeNumcells(node []byte) uint32 {
+	return binary.LittleEndian.Uint32(node[LEAF_NODE_NUM_CELLS_OFFSET:])
+}
+
+func setLeafNodeNumcells(node []byte, numCells uint32) {
+	binary.LittleEndian.PutUint32(node[LEAF_NODE_NUM_CELLS_OFFSET:], numCells)
 }
 
 func leafNodeCell(node []byte, cellNum uint32) []byte {
-	return node[LEAF_NODE_HEADER_SIZE+cellNum*uint32(LEAF_NODE_CELL_SIZE):]
+	offset := LEAF_NODE_HEADER_SIZE + cellNum*uint32(LEAF_NODE_CELL_SIZE)
+	return node[offset : offset+uint32(LEAF_NODE_CELL_SIZE)]
 }
 
-func leafNodeKey(node []byte, cellNum uint32) *uint32 {
-	return (*uint32)(unsafe.Pointer(&leafNodeCell(node, cellNum)[LEAF_NODE_KEY_OFFSET]))
+// zeroLeafCellsFrom clears every cell slot of a leaf from cellNum to the
+// end of the page, so rows moved out of it leave no stale copy behind.
+func zeroLeafCellsFrom(node []byte, cellNum uint32) {
+	clear(node[LEAF_NODE_HEADER_SIZE+cellNum*uint32(LEAF_NODE_CELL_SIZE):])
+}
+
+func leafNodeKey(node []byte, cellNum uint32) uint32 {
+	return binary.LittleEndian.Uint32(leafNodeCell(node, cellNum)[LEAF_NODE_KEY_OFFSET:])
+}
+
+func setLeafNodeKey(node []byte, cellNum uint32, key uint32) {
+	binary.LittleEndian.PutUint32(leafNodeCell(node, cellNum)[LEAF_NODE_KEY_OFFSET:], key)
 }
 
 func leafNodeValue(node []byte, cellNum uint32) []byte {
 	return leafNodeCell(node, cellNum)[LEAF_NODE_VALUE_OFFSET:]
 }
 
-func leafNodeFind(table *Table, pageNum uint32, key uint32) *Cursor {
-	node := getPage(table.pager, pageNum)
-	numCells := *leafNodeNumcells(node)
+func leafNodeFind(table *Table, pageNum uint32, key uint32) (*Cursor, error) {
+	node, err := getPage(table.pager, pageNum)
+	if err != nil {
+		return nil, err
+	}
+	numCells := leafNodeNumcells(node)
 
 	cursor := &Cursor{
 		table:   table,
@@ -154,10 +274,10 @@ func leafNodeFind(table *Table, pageNum uint32, key uint32) *Cursor {
 	onePastMaxIndex := numCells
 	for onePastMaxIndex != minIndex {
 		index := (minIndex + onePastMaxIndex) / 2
-		keyAtIndex := *leafNodeKey(node, index)
+		keyAtIndex := leafNodeKey(node, index)
 		if key == keyAtIndex {
 			cursor.cellNum = index
-			return cursor
+			return cursor, nil
 		}
 		if key < keyAtIndex {
 			onePastMaxIndex = index
@@ -166,32 +286,47 @@ func leafNodeFind(table *Table, pageNum uint32, key uint32) *Cursor {
 		}
 	}
 	cursor.cellNum = minIndex
-	return cursor
+	return cursor, nil
 }
 
-func leafNodeSplitAndInsert(cursor *Cursor, key uint32, value *Row) {
-	oldNode := getPage(cursor.table.pager, cursor.pageNum)
-	oldMax := getNodeMaxKey(cursor.table.pager, oldNode)
+func leafNodeSplitAndInsert(cursor *Cursor, key uint32, value *Row) error {
+	maxCells := cursor.table.leafNodeMaxCells
+	rightSplitCount := (maxCells + 1) / 2
+	leftSplitCount := maxCells + 1 - rightSplitCount
+
+	oldNode, err := getPage(cursor.table.pager, cursor.pageNum)
+	if err != nil {
+		return err
+	}
+	oldMax, err := getNodeMaxKey(cursor.table.pager, oldNode)
+	if err != nil {
+		return err
+	}
 	newPageNum := getUnusedPageNum(cursor.table.pager)
-	newNode := getPage(cursor.table.pager, newPageNum)
+	newNode, err := getPage(cursor.table.pager, newPageNum)
+	if err != nil {
+		return err
+	}
 	initializeLeafNode(newNode)
-	*leafNodeNextLeaf(newNode) = *leafNodeNextLeaf(oldNode)
-	*leafNodeNextLeaf(oldNode) = newPageNum
+	setNodeParent(newNode, nodeParent(oldNode))
+	setLeafNodeNextLeaf(newNode, leafNodeNextLeaf(oldNode))
+	setLeafNodeNextLeaf(oldNode, newPageNum)
 
-	for i := int32(LEAF_NODE_MAX_CELLS); i >= 0; i-- {
+	for i := int32(maxCells); i >= 0; i-- {
 		var destinationNode []byte
-		if i >= int32(LEAF_NODE_LEFT_SPLIT_COUNT) {
+		indexWithNode := i
+		if i >= int32(leftSplitCount) {
 			destinationNode = newNode
+			indexWithNode = i - int32(leftSplitCount)
 		} else {
 			destinationNode = oldNode
 		}
 
-		indexWithNode := i % int32(LEAF_NODE_LEFT_SPLIT_COUNT)
 		destination := leafNodeCell(destinationNode, uint32(indexWithNode))
 
 		if i == int32(cursor.cellNum) {
 			serializeRow(value, leafNodeValue(destinationNode, uint32(indexWithNode)))
-			*leafNodeKey(destinationNode, uint32(indexWithNode)) = key
+			setLeafNodeKey(destinationNode, uint32(indexWithNode), key)
 		} else if i > int32(cursor.cellNum) {
 			copy(destination, leafNodeCell(oldNode, uint32(i-1)))
 		} else {
@@ -199,23 +334,35 @@ func leafNodeSplitAndInsert(cursor *Cursor, key uint32, value *Row) {
 		}
 	}
 
-	*leafNodeNumcells(oldNode) = uint32(LEAF_NODE_LEFT_SPLIT_COUNT)
-	*leafNodeNumcells(newNode) = uint32(LEAF_NODE_RIGHT_SPLIT_COUNT)
+	setLeafNodeNumcells(oldNode, leftSplitCount)
+	setLeafNodeNumcells(newNode, rightSplitCount)
+	if cursor.table.zeroFreedCells {
+		zeroLeafCellsFrom(oldNode, leftSplitCount)
+	}
 
 	if isNodeRoot(oldNode) {
-		createNewRoot(cursor.table, newPageNum)
-	} else {
-		parentPageNum := *nodeParent(oldNode)
-		newMax := getNodeMaxKey(cursor.table.pager, oldNode)
-		parent := getPage(cursor.table.pager, parentPageNum)
-		updateInternalNodeKey(parent, oldMax, newMax)
-		internalNodeInsert(cursor.table, parentPageNum, newPageNum)
-		return
+		return createNewRoot(cursor.table, newPageNum)
 	}
+
+	parentPageNum := nodeParent(oldNode)
+	newMax, err := getNodeMaxKey(cursor.table.pager, oldNode)
+	if err != nil {
+		return err
+	}
+	parent, err := getPage(cursor.table.pager, parentPageNum)
+	if err != nil {
+		return err
+	}
+	updateInternalNodeKey(parent, oldMax, newMax)
+	return internalNodeInsert(cursor.table, parentPageNum, newPageNum)
+}
+
+func leafNodeNextLeaf(node []byte) uint32 {
+	return binary.LittleEndian.Uint32(node[LEAF_NODE_NEXT_LEAF_OFFSET:])
 }
 
-func leafNodeNextLeaf(node []byte) *uint32 {
-	return (*uint32)(unsafe.Pointer(&node[LEAF_NODE_NEXT_LEAF_OFFSET]))
+func setLeafNodeNextLeaf(node []byte, pageNum uint32) {
+	binary.LittleEndian.PutUint32(node[LEAF_NODE_NEXT_LEAF_OFFSET:], pageNum)
 }
 
 func printConstant() {
@@ -228,57 +375,357 @@ func printConstant() {
 }
 
 func printLeafNode(node []byte) {
-	numCells := *leafNodeNumcells(node)
+	numCells := leafNodeNumcells(node)
 	fmt.Printf("leaf (size %d)\n", numCells)
 	for i := uint32(0); i < numCells; i++ {
-		key := *leafNodeKey(node, i)
+		key := leafNodeKey(node, i)
 		fmt.Printf("   -  %d : %d\n", i, key)
 	}
 }
 
+// printPage decodes a single page according to its node type: a leaf's
+// rows, or an internal node's children and separator keys.
+func printPage(pager *Pager, pageNum uint32) error {
+	if pageNum >= pager.numPages {
+		return fmt.Errorf("page %d does not exist, the file has %d pages", pageNum, pager.numPages)
+	}
+	node, err := getPage(pager, pageNum)
+	if err != nil {
+		return err
+	}
+
+	switch getNodeType(node) {
+	case NODE_LEAF:
+		numCells := leafNodeNumcells(node)
+		fmt.Printf("leaf page %d (size %d, root %t, parent %d, next leaf %d)\n", pageNum, numCells, isNodeRoot(node), nodeParent(node), leafNodeNextLeaf(node))
+		var row Row
+		for i := uint32(0); i < numCells; i++ {
+			deserializeRow(&row, leafNodeValue(node, i))
+			fmt.Printf("   -  %d : %d (%d %s %s)\n", i, leafNodeKey(node, i), row.id, row.username, row.email)
+		}
+	case NODE_INTERNAL:
+		numKeys := internalNodeNumKeys(node)
+		fmt.Printf("internal page %d (size %d, root %t, parent %d)\n", pageNum, numKeys, isNodeRoot(node), nodeParent(node))
+		for i := uint32(0); i < numKeys; i++ {
+			fmt.Printf("   -  child %d, key %d\n", binary.LittleEndian.Uint32(internalNodeCell(node, i)), internalNodeKey(node, i))
+		}
+		fmt.Printf("   -  right child %d\n", internalNodeRightChild(node))
+	default:
+		return fmt.Errorf("page %d has unknown node type %d", pageNum, getNodeType(node))
+	}
+	return nil
+}
+
 func indent(level uint32) {
 	for i := uint32(0); i < level; i++ {
 		fmt.Printf(" ")
 	}
 }
 
-func printTree(pager *Pager, pageNum uint32, indentationLevel uint32) {
-	node := getPage(pager, pageNum)
+// printTree prints the subtree rooted at pageNum. visited collects the pages
+// printed so far; meeting one again means a corrupted pointer has made a
+// cycle, which is reported instead of printed forever.
+func printTree(pager *Pager, pageNum uint32, indentationLevel uint32, visited map[uint32]bool) error {
+	if visited[pageNum] {
+		return fmt.Errorf("cycle in tree: page %d reached twice", pageNum)
+	}
+	visited[pageNum] = true
+	node, err := getPage(pager, pageNum)
+	if err != nil {
+		return err
+	}
 	var numKeys uint32
 	var child uint32
 
 	switch getNodeType(node) {
 	case NODE_LEAF:
-		numKeys = *leafNodeNumcells(node)
+		numKeys = leafNodeNumcells(node)
 		indent(indentationLevel)
 		fmt.Printf(" - leaf(size %d)\n", numKeys)
 		for i := uint32(0); i < numKeys; i++ {
 			indent(indentationLevel + 1)
-			fmt.Printf(" -%d\n", *leafNodeKey(node, i))
+			fmt.Printf(" -%d\n", leafNodeKey(node, i))
 		}
 	case NODE_INTERNAL:
-		numKeys = *internalNodeNumKeys(node)
+		numKeys = internalNodeNumKeys(node)
 		indent(indentationLevel)
 		fmt.Printf(" - internal (size %d)\n", numKeys)
 		if numKeys > 0 {
 			for i := uint32(0); i < numKeys; i++ {
-				child = *internalNodeChild(node, i)
-				printTree(pager, child, indentationLevel+1)
+				child, err := internalNodeChild(node, i)
+				if err != nil {
+					return err
+				}
+				if err := printTree(pager, child, indentationLevel+1, visited); err != nil {
+					return err
+				}
 
 				indent(indentationLevel + 1)
-				fmt.Printf(" - key %d\n", *internalNodeKey(node, i))
+				fmt.Printf(" - key %d\n", internalNodeKey(node, i))
+			}
+			child = internalNodeRightChild(node)
+			return printTree(pager, child, indentationLevel+1, visited)
+		}
+	}
+	return nil
+}
+
+// TreeStats summarises the shape of a table's B-tree.
+type TreeStats struct {
+	height        uint32
+	internalPages uint32
+	leafPages     uint32
+	rows          uint32
+	// Average fraction of leafNodeMaxCells in use across the leaves.
+	leafFill float64
+}
+
+func treeStats(table *Table) (*TreeStats, error) {
+	stats := &TreeStats{}
+	if err := collectTreeStats(table.pager, table.rootPageNum, 1, stats, map[uint32]bool{}); err != nil {
+		return nil, err
+	}
+	stats.leafFill = float64(stats.rows) / float64(stats.leafPages*table.leafNodeMaxCells)
+	return stats, nil
+}
+
+func collectTreeStats(pager *Pager, pageNum uint32, depth uint32, stats *TreeStats, visited map[uint32]bool) error {
+	if visited[pageNum] {
+		return fmt.Errorf("cycle in tree: page %d reached twice", pageNum)
+	}
+	visited[pageNum] = true
+	node, err := getPage(pager, pageNum)
+	if err != nil {
+		return err
+	}
+	stats.height = max(stats.height, depth)
+
+	switch getNodeType(node) {
+	case NODE_LEAF:
+		stats.leafPages++
+		stats.rows += leafNodeNumcells(node)
+	case NODE_INTERNAL:
+		stats.internalPages++
+		for i := uint32(0); i <= internalNodeNumKeys(node); i++ {
+			child, err := internalNodeChild(node, i)
+			if err != nil {
+				return err
+			}
+			if err := collectTreeStats(pager, child, depth+1, stats, visited); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func printTreeStats(stats *TreeStats) {
+	fmt.Printf("height: %d\n", stats.height)
+	fmt.Printf("internal pages: %d\n", stats.internalPages)
+	fmt.Printf("leaf pages: %d\n", stats.leafPages)
+	fmt.Printf("rows: %d\n", stats.rows)
+	fmt.Printf("leaf fill: %.1f%%\n", stats.leafFill*100)
+}
+
+// writeDot writes the tree as a Graphviz digraph. Internal nodes list their
+// separator keys and leaves their keys; each edge is labelled with the page
+// number of the child it leads to.
+func writeDot(w io.Writer, pager *Pager) error {
+	fmt.Fprintln(w, "digraph btree {")
+	fmt.Fprintln(w, "  node [shape=record];")
+	if err := writeDotNode(w, pager, 0, map[uint32]bool{}); err != nil {
+		return err
+	}
+	fmt.Fprintln(w, "}")
+	return nil
+}
+
+func writeDotNode(w io.Writer, pager *Pager, pageNum uint32, visited map[uint32]bool) error {
+	if visited[pageNum] {
+		return fmt.Errorf("cycle in tree: page %d reached twice", pageNum)
+	}
+	visited[pageNum] = true
+	node, err := getPage(pager, pageNum)
+	if err != nil {
+		return err
+	}
+
+	switch getNodeType(node) {
+	case NODE_LEAF:
+		label := "leaf"
+		for i := uint32(0); i < leafNodeNumcells(node); i++ {
+			label += fmt.Sprintf(" | %d", leafNodeKey(node, i))
+		}
+		fmt.Fprintf(w, "  page%d [label=\"%s\"];\n", pageNum, label)
+	case NODE_INTERNAL:
+		numKeys := internalNodeNumKeys(node)
+		label := "internal"
+		for i := uint32(0); i < numKeys; i++ {
+			label += fmt.Sprintf(" | %d", internalNodeKey(node, i))
+		}
+		fmt.Fprintf(w, "  page%d [label=\"%s\"];\n", pageNum, label)
+		for i := uint32(0); i <= numKeys; i++ {
+			child, err := internalNodeChild(node, i)
+			if err != nil {
+				return err
+			}
+			fmt.Fprintf(w, "  page%d -> page%d [label=\"%d\"];\n", pageNum, child, child)
+			if err := writeDotNode(w, pager, child, visited); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// relinkLeaves rebuilds the leaf chain from the tree itself: the leaves are
+// collected left to right through the internal nodes' children and each
+// next-leaf pointer is rewritten to the leaf that follows it.
+func relinkLeaves(table *Table) error {
+	var leaves []uint32
+	if err := collectLeaves(table.pager, table.rootPageNum, map[uint32]bool{}, &leaves); err != nil {
+		return err
+	}
+	for i, pageNum := range leaves {
+		next := uint32(0)
+		if i+1 < len(leaves) {
+			next = leaves[i+1]
+		}
+		node, err := getPage(table.pager, pageNum)
+		if err != nil {
+			return err
+		}
+		setLeafNodeNextLeaf(node, next)
+	}
+	return nil
+}
+
+func collectLeaves(pager *Pager, pageNum uint32, visited map[uint32]bool, leaves *[]uint32) error {
+	if visited[pageNum] {
+		return fmt.Errorf("cycle in tree: page %d reached twice", pageNum)
+	}
+	visited[pageNum] = true
+	node, err := getPage(pager, pageNum)
+	if err != nil {
+		return err
+	}
+
+	switch getNodeType(node) {
+	case NODE_LEAF:
+		*leaves = append(*leaves, pageNum)
+	case NODE_INTERNAL:
+		for i := uint32(0); i <= internalNodeNumKeys(node); i++ {
+			child, err := internalNodeChild(node, i)
+			if err != nil {
+				return err
+			}
+			if err := collectLeaves(pager, child, visited, leaves); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// checkTree walks the whole tree and reports the first structural problem
+// it finds: a page reached twice, keys out of order or outside their
+// parent's separators, a wrong parent pointer or root flag, or a leaf chain
+// that does not link the leaves left to right.
+func checkTree(table *Table) error {
+	visited := map[uint32]bool{}
+	var leaves []uint32
+	if err := checkNode(table.pager, table.rootPageNum, INVALID_PAGE_NUM, -1, math.MaxUint32, visited, &leaves); err != nil {
+		return err
+	}
+
+	chained := map[uint32]bool{}
+	pageNum := leaves[0]
+	for i := 0; ; i++ {
+		if chained[pageNum] {
+			return fmt.Errorf("cycle in leaf chain at page %d", pageNum)
+		}
+		chained[pageNum] = true
+		if i >= len(leaves) || leaves[i] != pageNum {
+			return fmt.Errorf("leaf chain reaches page %d out of order", pageNum)
+		}
+		node, err := getPage(table.pager, pageNum)
+		if err != nil {
+			return err
+		}
+		next := leafNodeNextLeaf(node)
+		if next == 0 {
+			if i != len(leaves)-1 {
+				return fmt.Errorf("leaf chain ends at page %d before page %d", pageNum, leaves[i+1])
+			}
+			return nil
+		}
+		pageNum = next
+	}
+}
+
+// checkNode checks the subtree at pageNum, whose keys must lie in (low, high],
+// and appends its leaves to leaves in key order.
+func checkNode(pager *Pager, pageNum uint32, parentPageNum uint32, low int64, high int64, visited map[uint32]bool, leaves *[]uint32) error {
+	if pageNum >= pager.numPages {
+		return fmt.Errorf("page %d is past the end of the file", pageNum)
+	}
+	if visited[pageNum] {
+		return fmt.Errorf("cycle in tree: page %d reached twice", pageNum)
+	}
+	visited[pageNum] = true
+
+	node, err := getPage(pager, pageNum)
+	if err != nil {
+		return err
+	}
+	if isNodeRoot(node) != (parentPageNum == INVALID_PAGE_NUM) {
+		return fmt.Errorf("page %d has the wrong root flag", pageNum)
+	}
+	if parentPageNum != INVALID_PAGE_NUM && nodeParent(node) != parentPageNum {
+		return fmt.Errorf("page %d has parent %d, expected %d", pageNum, nodeParent(node), parentPageNum)
+	}
+
+	switch getNodeType(node) {
+	case NODE_LEAF:
+		previous := low
+		for i := uint32(0); i < leafNodeNumcells(node); i++ {
+			key := int64(leafNodeKey(node, i))
+			if key <= previous || key > high {
+				return fmt.Errorf("leaf page %d has key %d out of order", pageNum, key)
+			}
+			previous = key
+		}
+		*leaves = append(*leaves, pageNum)
+	case NODE_INTERNAL:
+		previous := low
+		for i := uint32(0); i < internalNodeNumKeys(node); i++ {
+			key := int64(internalNodeKey(node, i))
+			if key <= previous || key > high {
+				return fmt.Errorf("internal page %d has key %d out of order", pageNum, key)
+			}
+			child, err := internalNodeChild(node, i)
+			if err != nil {
+				return err
+			}
+			if err := checkNode(pager, child, pageNum, previous, key, visited, leaves); err != nil {
+				return err
 			}
-			child = *internalNodeRightChild(node)
-			printTree(pager, child, indentationLevel+1)
+			previous = key
 		}
+		if err := checkNode(pager, internalNodeRightChild(node), pageNum, previous, high, visited, leaves); err != nil {
+			return err
+		}
+	default:
+		return fmt.Errorf("page %d has unknown node type %d", pageNum, getNodeType(node))
 	}
+	return nil
 }
 
 func initializeLeafNode(node []byte) {
 	setNodeType(node, NODE_LEAF)
 	setNodeRoot(node, false)
-	*leafNodeNumcells(node) = 0
-	*leafNodeNextLeaf(node) = 0
+	setLeafNodeNumcells(node, 0)
+	setLeafNodeNextLeaf(node, 0)
 }
 
 const (
@@ -290,178 +737,639 @@ const (
 	INTERNAL_NODE_KEY_SIZE           = 4
 	INTERNAL_NODE_CHILD_SIZE         = 4
 	INTERNAL_NODE_CELL_SIZE          = INTERNAL_NODE_CHILD_SIZE + INTERNAL_NODE_KEY_SIZE
-	INTERNAL_NODE_MAX_CELLS          = 3
+	INTERNAL_NODE_SPACE_FOR_CELLS    = PAGE_SIZE - INTERNAL_NODE_HEADER_SIZE
+	INTERNAL_NODE_MAX_CELLS          = INTERNAL_NODE_SPACE_FOR_CELLS / INTERNAL_NODE_CELL_SIZE
 )
 
-func internalNodeNumKeys(node []byte) *uint32 {
-	return (*uint32)(unsafe.Pointer(&node[INTERNAL_NODE_NUM_KEYS_OFFSET]))
+func internalNodeNumKeys(node []byte) uint32 {
+	return binary.LittleEndian.Uint32(node[INTERNAL_NODE_NUM_KEYS_OFFSET:])
+}
+
+func setInternalNodeNumKeys(node []byte, numKeys uint32) {
+	binary.LittleEndian.PutUint32(node[INTERNAL_NODE_NUM_KEYS_OFFSET:], numKeys)
+}
+
+func internalNodeRightChild(node []byte) uint32 {
+	return binary.LittleEndian.Uint32(node[INTERNAL_NODE_RIGHT_CHILD_OFFSET:])
 }
 
-func internalNodeRightChild(node []byte) *uint32 {
-	return (*uint32)(unsafe.Pointer(&node[INTERNAL_NODE_RIGHT_CHILD_OFFSET]))
+func setInternalNodeRightChild(node []byte, pageNum uint32) {
+	binary.LittleEndian.PutUint32(node[INTERNAL_NODE_RIGHT_CHILD_OFFSET:], pageNum)
 }
 
 func internalNodeCellI(node []byte, cellNum uint32) []byte {
-	return node[INTERNAL_NODE_HEADER_SIZE+cellNum*INTERNAL_NODE_CELL_SIZE:]
+	return internalNodeCell(node, cellNum)
 }
 
 func internalNodeCell(node []byte, cellNum uint32) []byte {
 	offset := INTERNAL_NODE_HEADER_SIZE + cellNum*INTERNAL_NODE_CELL_SIZE
-	return node[offset:]
+	return node[offset : offset+INTERNAL_NODE_CELL_SIZE]
 }
 
-func internalNodeChild(node []byte, childNum uint32) *uint32 {
-	numKeys := *internalNodeNumKeys(node)
+func internalNodeChild(node []byte, childNum uint32) (uint32, error) {
+	numKeys := internalNodeNumKeys(node)
 	if childNum > numKeys {
-		fmt.Printf("Tried to access child_num %d > num_keys %d\n", childNum, numKeys)
-		os.Exit(1)
+		return 0, fmt.Errorf("tried to access child_num %d > num_keys %d", childNum, numKeys)
 	}
 
 	if childNum == numKeys {
 		rightChild := internalNodeRightChild(node)
-		if *rightChild == INVALID_PAGE_NUM {
-			fmt.Println("Tried to access right child of node, but was invalid page")
-			os.Exit(1)
+		if rightChild == INVALID_PAGE_NUM {
+			return 0, fmt.Errorf("tried to access right child of node, but was invalid page")
 		}
-		return rightChild
+		return rightChild, nil
 	}
 
-	child := internalNodeCell(node, childNum)
-	if *(*uint32)(unsafe.Pointer(&child[0])) == INVALID_PAGE_NUM {
-		fmt.Printf("Tried to access child %d of node, but was invalid page\n", childNum)
-		os.Exit(1)
+	child := binary.LittleEndian.Uint32(internalNodeCell(node, childNum))
+	if child == INVALID_PAGE_NUM {
+		return 0, fmt.Errorf("tried to access child %d of node, but was invalid page", childNum)
+	}
+	return child, nil
+}
+
+// setInternalNodeChild stores pageNum as child childNum, where childNum ==
+// num_keys addresses the right child. Unlike internalNodeChild it does not
+// care what the slot held before.
+func setInternalNodeChild(node []byte, childNum uint32, pageNum uint32) error {
+	numKeys := internalNodeNumKeys(node)
+	if childNum > numKeys {
+		return fmt.Errorf("tried to access child_num %d > num_keys %d", childNum, numKeys)
+	}
+
+	if childNum == numKeys {
+		setInternalNodeRightChild(node, pageNum)
+		return nil
 	}
-	return (*uint32)(unsafe.Pointer(&child[0]))
+	binary.LittleEndian.PutUint32(internalNodeCell(node, childNum), pageNum)
+	return nil
+}
+
+func internalNodeKey(node []byte, keyNum uint32) uint32 {
+	return binary.LittleEndian.Uint32(internalNodeCell(node, keyNum)[INTERNAL_NODE_CHILD_SIZE:])
 }
 
-func internalNodeKey(node []byte, keyNum uint32) *uint32 {
-	return (*uint32)(unsafe.Pointer(uintptr(unsafe.Pointer(&internalNodeCellI(node, keyNum)[0])) + INTERNAL_NODE_CHILD_SIZE))
+func setInternalNodeKey(node []byte, keyNum uint32, key uint32) {
+	binary.LittleEndian.PutUint32(internalNodeCell(node, keyNum)[INTERNAL_NODE_CHILD_SIZE:], key)
 }
 
-func internalNodeInsert(table *Table, parentPageNum uint32, childPageNum uint32) {
-	parent := getPage(table.pager, parentPageNum)
-	child := getPage(table.pager, childPageNum)
+func internalNodeInsert(table *Table, parentPageNum uint32, childPageNum uint32) error {
+	parent, err := getPage(table.pager, parentPageNum)
+	if err != nil {
+		return err
+	}
+	child, err := getPage(table.pager, childPageNum)
+	if err != nil {
+		return err
+	}
 
-	childMaxKey := getNodeMaxKey(table.pager, child)
+	childMaxKey, err := getNodeMaxKey(table.pager, child)
+	if err != nil {
+		return err
+	}
 	index := internalNodeFindChild(parent, childMaxKey)
 
-	originalNumKeys := *internalNodeNumKeys(parent)
-	*internalNodeNumKeys(parent) = originalNumKeys + 1
+	originalNumKeys := internalNodeNumKeys(parent)
+	if originalNumKeys >= table.internalNodeMaxCells {
+		return internalNodeSplitAndInsert(table, parentPageNum, childPageNum)
+	}
 
-	if originalNumKeys >= INTERNAL_NODE_MAX_CELLS {
-		internalNodeSplitAndInsert(table, parentPageNum, childPageNum)
+	rightChildPageNum := internalNodeRightChild(parent)
+	/* An empty internal node takes its first child as the right child */
+	if rightChildPageNum == INVALID_PAGE_NUM {
+		setInternalNodeRightChild(parent, childPageNum)
+		return nil
 	}
 
-	rightChildPageNum := *internalNodeRightChild(parent)
-	rightChild := getPage(table.pager, rightChildPageNum)
+	rightChild, err := getPage(table.pager, rightChildPageNum)
+	if err != nil {
+		return err
+	}
+	rightChildMaxKey, err := getNodeMaxKey(table.pager, rightChild)
+	if err != nil {
+		return err
+	}
+	setInternalNodeNumKeys(parent, originalNumKeys+1)
 
-	if childMaxKey > getNodeMaxKey(table.pager, rightChild) {
-		*internalNodeChild(parent, originalNumKeys) = rightChildPageNum
-		*internalNodeKey(parent, originalNumKeys) = getNodeMaxKey(table.pager, rightChild)
-		*internalNodeRightChild(parent) = childPageNum
+	if childMaxKey > rightChildMaxKey {
+		if err := setInternalNodeChild(parent, originalNumKeys, rightChildPageNum); err != nil {
+			return err
+		}
+		setInternalNodeKey(parent, originalNumKeys, rightChildMaxKey)
+		setInternalNodeRightChild(parent, childPageNum)
 	} else {
 		for i := originalNumKeys; i > index; i-- {
 			destination := internalNodeCellI(parent, i)
 			source := internalNodeCellI(parent, i-1)
 			copy(destination, source)
 		}
-		*internalNodeChild(parent, index) = childPageNum
-		*internalNodeKey(parent, index) = childMaxKey
+		if err := setInternalNodeChild(parent, index, childPageNum); err != nil {
+			return err
+		}
+		setInternalNodeKey(parent, index, childMaxKey)
 	}
+	return nil
 }
 
-func nodeParent(node []byte) *uint32 {
-	return (*uint32)(unsafe.Pointer(&node[PARENT_POINTER_OFFSET]))
-}
-
-func internalNodeFindChild(node []byte, key uint32) uint32 {
-	numKeys := *internalNodeNumKeys(node)
-	minIndex := uint32(0)
-	maxIndex := numKeys
-
-	for minIndex != maxIndex {
-		index := (minIndex + maxIndex) / 2
-		keyToRight := *internalNodeKey(node, index)
-		if keyToRight >= key {
-			maxIndex = index
-		} else {
-			minIndex = index + 1
+// internalNodeChildIndex returns which child of node childPageNum is, with
+// the right child at index numKeys.
+func internalNodeChildIndex(node []byte, childPageNum uint32) (uint32, error) {
+	numKeys := internalNodeNumKeys(node)
+	if internalNodeRightChild(node) == childPageNum {
+		return numKeys, nil
+	}
+	for i := uint32(0); i < numKeys; i++ {
+		if binary.LittleEndian.Uint32(internalNodeCell(node, i)) == childPageNum {
+			return i, nil
 		}
 	}
-	return minIndex
+	return 0, fmt.Errorf("page %d is not a child of its parent", childPageNum)
 }
 
-func internalNodeSplitAndInsert(table *Table, parentPageNum uint32, childPageNum uint32) {
-	oldPageNum := parentPageNum
-	oldNode := getPage(table.pager, parentPageNum)
-	oldMax := getNodeMaxKey(table.pager, oldNode)
-
-	child := getPage(table.pager, childPageNum)
-	childMax := getNodeMaxKey(table.pager, child)
+// leafNodeMinCells is the fewest cells a non-root leaf keeps after a
+// delete: the size of the smaller half of a split, so a split never
+// leaves a leaf that a delete would immediately have to rebalance.
+func leafNodeMinCells(table *Table) uint32 {
+	return (table.leafNodeMaxCells + 1) / 2
+}
 
-	newPageNum := getUnusedPageNum(table.pager)
-	splittingRoot := isNodeRoot(oldNode)
+// internalNodeMinKeys is the fewest keys a non-root internal node keeps
+// after a delete, again the smaller half of a split.
+func internalNodeMinKeys(table *Table) uint32 {
+	return (table.internalNodeMaxCells - 1) / 2
+}
 
-	var parent, newNode []byte
-	if splittingRoot {
-		createNewRoot(table, newPageNum)
-		parent = getPage(table.pager, table.rootPageNum)
-		oldPageNum = *internalNodeChild(parent, 0)
-		oldNode = getPage(table.pager, oldPageNum)
-	} else {
-		parent = getPage(table.pager, *nodeParent(oldNode))
-		newNode = getPage(table.pager, newPageNum)
-		initializeInternalNode(newNode)
+// siblingPair returns the children of parent to rebalance the child at
+// index with: that child and its left sibling, or its right sibling when it
+// is the leftmost child. leftIndex is the left one's position in parent.
+func siblingPair(parent []byte, index uint32) (leftIndex uint32, leftPageNum uint32, rightPageNum uint32, err error) {
+	if index > 0 {
+		leftIndex = index - 1
 	}
-
-	oldNumKeys := internalNodeNumKeys(oldNode)
-	curPageNum := *internalNodeRightChild(oldNode)
-	cur := getPage(table.pager, curPageNum)
-
-	internalNodeInsert(table, newPageNum, curPageNum)
-	*nodeParent(cur) = newPageNum
-	*internalNodeRightChild(oldNode) = INVALID_PAGE_NUM
-
-	for i := int(INTERNAL_NODE_MAX_CELLS) - 1; i > INTERNAL_NODE_MAX_CELLS/2; i-- {
-		curPageNum = *internalNodeChild(oldNode, uint32(i))
-		cur = getPage(table.pager, curPageNum)
-
-		internalNodeInsert(table, newPageNum, curPageNum)
-		*nodeParent(cur) = newPageNum
-		(*oldNumKeys)--
+	leftPageNum, err = internalNodeChild(parent, leftIndex)
+	if err != nil {
+		return 0, 0, 0, err
 	}
-
-	*internalNodeRightChild(oldNode) = *internalNodeChild(oldNode, *oldNumKeys-1)
-	(*oldNumKeys)--
-
-	maxAfterSplit := getNodeMaxKey(table.pager, oldNode)
-	destinationPageNum := oldPageNum
-	if childMax >= maxAfterSplit {
-		destinationPageNum = newPageNum
+	rightPageNum, err = internalNodeChild(parent, leftIndex+1)
+	if err != nil {
+		return 0, 0, 0, err
 	}
+	return leftIndex, leftPageNum, rightPageNum, nil
+}
 
-	internalNodeInsert(table, destinationPageNum, childPageNum)
-	*nodeParent(child) = destinationPageNum
-
-	updateInternalNodeKey(parent, oldMax, getNodeMaxKey(table.pager, oldNode))
+// leafNodeRebalance fixes a leaf that dropped below leafNodeMinCells. If it
+// and a sibling fit in one page they are merged, otherwise the sibling
+// lends it a cell and the separator between them moves.
+func leafNodeRebalance(table *Table, pageNum uint32) error {
+	node, err := getPage(table.pager, pageNum)
+	if err != nil {
+		return err
+	}
+	parentPageNum := nodeParent(node)
+	parent, err := getPage(table.pager, parentPageNum)
+	if err != nil {
+		return err
+	}
+	if internalNodeNumKeys(parent) == 0 {
+		return nil
+	}
+	index, err := internalNodeChildIndex(parent, pageNum)
+	if err != nil {
+		return err
+	}
+	leftIndex, leftPageNum, rightPageNum, err := siblingPair(parent, index)
+	if err != nil {
+		return err
+	}
+	left, err := getPage(table.pager, leftPageNum)
+	if err != nil {
+		return err
+	}
+	right, err := getPage(table.pager, rightPageNum)
+	if err != nil {
+		return err
+	}
+	leftCells := leafNodeNumcells(left)
+	rightCells := leafNodeNumcells(right)
 
-	if !splittingRoot {
-		internalNodeInsert(table, *nodeParent(oldNode), newPageNum)
-		*nodeParent(newNode) = *nodeParent(oldNode)
+	if leftCells+rightCells <= table.leafNodeMaxCells {
+		leafNodeMerge(left, right)
+		if table.zeroFreedCells {
+			clear(right)
+		}
+		return internalNodeRemoveKey(table, parentPageNum, leftIndex)
 	}
-}
 
-func getNodeMaxKey(pager *Pager, node []byte) uint32 {
+	oldMax, err := getNodeMaxKey(table.pager, left)
+	if err != nil {
+		return err
+	}
+	if leftCells > rightCells {
+		for i := rightCells; i > 0; i-- {
+			copy(leafNodeCell(right, i), leafNodeCell(right, i-1))
+		}
+		copy(leafNodeCell(right, 0), leafNodeCell(left, leftCells-1))
+		setLeafNodeNumcells(left, leftCells-1)
+		setLeafNodeNumcells(right, rightCells+1)
+		if table.zeroFreedCells {
+			zeroLeafCellsFrom(left, leftCells-1)
+		}
+	} else {
+		copy(leafNodeCell(left, leftCells), leafNodeCell(right, 0))
+		for i := uint32(0); i+1 < rightCells; i++ {
+			copy(leafNodeCell(right, i), leafNodeCell(right, i+1))
+		}
+		setLeafNodeNumcells(left, leftCells+1)
+		setLeafNodeNumcells(right, rightCells-1)
+		if table.zeroFreedCells {
+			zeroLeafCellsFrom(right, rightCells-1)
+		}
+	}
+	newMax, err := getNodeMaxKey(table.pager, left)
+	if err != nil {
+		return err
+	}
+	updateInternalNodeKey(parent, oldMax, newMax)
+	return nil
+}
+
+// leafNodeMerge appends the cells of right to left and takes right out of
+// the leaf chain. The caller removes right from the parent.
+func leafNodeMerge(left []byte, right []byte) {
+	leftCells := leafNodeNumcells(left)
+	rightCells := leafNodeNumcells(right)
+	for i := uint32(0); i < rightCells; i++ {
+		copy(leafNodeCell(left, leftCells+i), leafNodeCell(right, i))
+	}
+	setLeafNodeNumcells(left, leftCells+rightCells)
+	setLeafNodeNextLeaf(left, leafNodeNextLeaf(right))
+}
+
+// internalNodeRemoveKey removes key keyIndex and the child to its right from
+// the internal node at pageNum, after that child has been merged into the
+// one on its left. The left child takes over the removed separator's range.
+// A root left with no keys is replaced by its only child, shrinking the
+// tree by a level; any other node left too small is rebalanced in turn.
+// Pages dropped this way are not reused; there is no free list.
+func internalNodeRemoveKey(table *Table, pageNum uint32, keyIndex uint32) error {
+	node, err := getPage(table.pager, pageNum)
+	if err != nil {
+		return err
+	}
+	numKeys := internalNodeNumKeys(node)
+	if keyIndex+1 == numKeys {
+		child, err := internalNodeChild(node, keyIndex)
+		if err != nil {
+			return err
+		}
+		setInternalNodeRightChild(node, child)
+	} else {
+		setInternalNodeKey(node, keyIndex, internalNodeKey(node, keyIndex+1))
+		for i := keyIndex + 1; i+1 < numKeys; i++ {
+			copy(internalNodeCell(node, i), internalNodeCell(node, i+1))
+		}
+	}
+	setInternalNodeNumKeys(node, numKeys-1)
+
+	if isNodeRoot(node) {
+		if numKeys-1 == 0 {
+			return collapseRoot(table)
+		}
+		return nil
+	}
+	if numKeys-1 < internalNodeMinKeys(table) {
+		return internalNodeRebalance(table, pageNum)
+	}
+	return nil
+}
+
+// internalNodeRebalance is leafNodeRebalance for internal nodes. A merge
+// pulls the parent's separator down between the two nodes' children; a
+// borrow rotates one child across, through the parent's separator.
+func internalNodeRebalance(table *Table, pageNum uint32) error {
+	node, err := getPage(table.pager, pageNum)
+	if err != nil {
+		return err
+	}
+	parentPageNum := nodeParent(node)
+	parent, err := getPage(table.pager, parentPageNum)
+	if err != nil {
+		return err
+	}
+	if internalNodeNumKeys(parent) == 0 {
+		return nil
+	}
+	index, err := internalNodeChildIndex(parent, pageNum)
+	if err != nil {
+		return err
+	}
+	leftIndex, leftPageNum, rightPageNum, err := siblingPair(parent, index)
+	if err != nil {
+		return err
+	}
+	left, err := getPage(table.pager, leftPageNum)
+	if err != nil {
+		return err
+	}
+	right, err := getPage(table.pager, rightPageNum)
+	if err != nil {
+		return err
+	}
+	leftKeys := internalNodeNumKeys(left)
+	rightKeys := internalNodeNumKeys(right)
+	separator := internalNodeKey(parent, leftIndex)
+
+	if leftKeys+rightKeys+1 <= table.internalNodeMaxCells {
+		leftRightChild := internalNodeRightChild(left)
+		setInternalNodeNumKeys(left, leftKeys+rightKeys+1)
+		if err := setInternalNodeChild(left, leftKeys, leftRightChild); err != nil {
+			return err
+		}
+		setInternalNodeKey(left, leftKeys, separator)
+		for i := uint32(0); i <= rightKeys; i++ {
+			child, err := internalNodeChild(right, i)
+			if err != nil {
+				return err
+			}
+			if err := setPageParent(table.pager, child, leftPageNum); err != nil {
+				return err
+			}
+			if i < rightKeys {
+				copy(internalNodeCell(left, leftKeys+1+i), internalNodeCell(right, i))
+			} else {
+				setInternalNodeRightChild(left, child)
+			}
+		}
+		if table.zeroFreedCells {
+			clear(right)
+		}
+		return internalNodeRemoveKey(table, parentPageNum, leftIndex)
+	}
+
+	if leftKeys > rightKeys {
+		moved := internalNodeRightChild(left)
+		for i := rightKeys; i > 0; i-- {
+			copy(internalNodeCell(right, i), internalNodeCell(right, i-1))
+		}
+		setInternalNodeNumKeys(right, rightKeys+1)
+		if err := setInternalNodeChild(right, 0, moved); err != nil {
+			return err
+		}
+		setInternalNodeKey(right, 0, separator)
+		newRightChild, err := internalNodeChild(left, leftKeys-1)
+		if err != nil {
+			return err
+		}
+		setInternalNodeKey(parent, leftIndex, internalNodeKey(left, leftKeys-1))
+		setInternalNodeRightChild(left, newRightChild)
+		setInternalNodeNumKeys(left, leftKeys-1)
+		if err := setPageParent(table.pager, moved, rightPageNum); err != nil {
+			return err
+		}
+		return nil
+	}
+
+	moved, err := internalNodeChild(right, 0)
+	if err != nil {
+		return err
+	}
+	leftRightChild := internalNodeRightChild(left)
+	setInternalNodeNumKeys(left, leftKeys+1)
+	if err := setInternalNodeChild(left, leftKeys, leftRightChild); err != nil {
+		return err
+	}
+	setInternalNodeKey(left, leftKeys, separator)
+	setInternalNodeRightChild(left, moved)
+	setInternalNodeKey(parent, leftIndex, internalNodeKey(right, 0))
+	for i := uint32(0); i+1 < rightKeys; i++ {
+		copy(internalNodeCell(right, i), internalNodeCell(right, i+1))
+	}
+	setInternalNodeNumKeys(right, rightKeys-1)
+	if err := setPageParent(table.pager, moved, leftPageNum); err != nil {
+		return err
+	}
+	return nil
+}
+
+// collapseRoot replaces a root internal node that has no keys left with its
+// only child. The root stays at rootPageNum, so the child's contents are
+// copied up and its own children re-parented.
+func collapseRoot(table *Table) error {
+	root, err := getPage(table.pager, table.rootPageNum)
+	if err != nil {
+		return err
+	}
+	childPageNum := internalNodeRightChild(root)
+	child, err := getPage(table.pager, childPageNum)
+	if err != nil {
+		return err
+	}
+	copy(root, child)
+	if table.zeroFreedCells {
+		clear(child)
+	}
+	setNodeRoot(root, true)
+	setNodeParent(root, 0)
+	if getNodeType(root) == NODE_INTERNAL {
+		for i := uint32(0); i <= internalNodeNumKeys(root); i++ {
+			grandchild, err := internalNodeChild(root, i)
+			if err != nil {
+				return err
+			}
+			if err := setPageParent(table.pager, grandchild, table.rootPageNum); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func nodeParent(node []byte) uint32 {
+	return binary.LittleEndian.Uint32(node[PARENT_POINTER_OFFSET:])
+}
+
+func setNodeParent(node []byte, pageNum uint32) {
+	binary.LittleEndian.PutUint32(node[PARENT_POINTER_OFFSET:], pageNum)
+}
+
+// setPageParent sets the parent pointer of the node stored at pageNum.
+func setPageParent(pager *Pager, pageNum uint32, parentPageNum uint32) error {
+	node, err := getPage(pager, pageNum)
+	if err != nil {
+		return err
+	}
+	setNodeParent(node, parentPageNum)
+	return nil
+}
+
+func internalNodeFindChild(node []byte, key uint32) uint32 {
+	numKeys := internalNodeNumKeys(node)
+	minIndex := uint32(0)
+	maxIndex := numKeys
+
+	for minIndex != maxIndex {
+		index := (minIndex + maxIndex) / 2
+		keyToRight := internalNodeKey(node, index)
+		if keyToRight >= key {
+			maxIndex = index
+		} else {
+			minIndex = index + 1
+		}
+	}
+	return minIndex
+}
+
+func internalNodeSplitAndInsert(table *Table, parentPageNum uint32, childPageNum uint32) error {
+	oldPageNum := parentPageNum
+	oldNode, err := getPage(table.pager, parentPageNum)
+	if err != nil {
+		return err
+	}
+	oldMax, err := getNodeMaxKey(table.pager, oldNode)
+	if err != nil {
+		return err
+	}
+
+	child, err := getPage(table.pager, childPageNum)
+	if err != nil {
+		return err
+	}
+	childMax, err := getNodeMaxKey(table.pager, child)
+	if err != nil {
+		return err
+	}
+
+	newPageNum := getUnusedPageNum(table.pager)
+	splittingRoot := isNodeRoot(oldNode)
+
+	var parent, newNode []byte
+	if splittingRoot {
+		if err := createNewRoot(table, newPageNum); err != nil {
+			return err
+		}
+		parent, err = getPage(table.pager, table.rootPageNum)
+		if err != nil {
+			return err
+		}
+		oldPageNum, err = internalNodeChild(parent, 0)
+		if err != nil {
+			return err
+		}
+		oldNode, err = getPage(table.pager, oldPageNum)
+		if err != nil {
+			return err
+		}
+	} else {
+		parent, err = getPage(table.pager, nodeParent(oldNode))
+		if err != nil {
+			return err
+		}
+		newNode, err = getPage(table.pager, newPageNum)
+		if err != nil {
+			return err
+		}
+		initializeInternalNode(newNode)
+	}
+
+	curPageNum := internalNodeRightChild(oldNode)
+	cur, err := getPage(table.pager, curPageNum)
+	if err != nil {
+		return err
+	}
+
+	if err := internalNodeInsert(table, newPageNum, curPageNum); err != nil {
+		return err
+	}
+	setNodeParent(cur, newPageNum)
+	setInternalNodeRightChild(oldNode, INVALID_PAGE_NUM)
+
+	maxCells := int(table.internalNodeMaxCells)
+	for i := maxCells - 1; i > maxCells/2; i-- {
+		curPageNum, err = internalNodeChild(oldNode, uint32(i))
+		if err != nil {
+			return err
+		}
+		cur, err = getPage(table.pager, curPageNum)
+		if err != nil {
+			return err
+		}
+
+		if err := internalNodeInsert(table, newPageNum, curPageNum); err != nil {
+			return err
+		}
+		setNodeParent(cur, newPageNum)
+		setInternalNodeNumKeys(oldNode, internalNodeNumKeys(oldNode)-1)
+	}
+
+	lastChild, err := internalNodeChild(oldNode, internalNodeNumKeys(oldNode)-1)
+	if err != nil {
+		return err
+	}
+	setInternalNodeRightChild(oldNode, lastChild)
+	setInternalNodeNumKeys(oldNode, internalNodeNumKeys(oldNode)-1)
+
+	maxAfterSplit, err := getNodeMaxKey(table.pager, oldNode)
+	if err != nil {
+		return err
+	}
+	destinationPageNum := oldPageNum
+	if childMax >= maxAfterSplit {
+		destinationPageNum = newPageNum
+	}
+
+	if err := internalNodeInsert(table, destinationPageNum, childPageNum); err != nil {
+		return err
+	}
+	setNodeParent(child, destinationPageNum)
+
+	newMax, err := getNodeMaxKey(table.pager, oldNode)
+	if err != nil {
+		return err
+	}
+	updateInternalNodeKey(parent, oldMax, newMax)
+
+	if !splittingRoot {
+		/* Set the parent first: a cascading split of the grandparent may move newNode */
+		setNodeParent(newNode, nodeParent(oldNode))
+		if err := internalNodeInsert(table, nodeParent(oldNode), newPageNum); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func getNodeMaxKey(pager *Pager, node []byte) (uint32, error) {
 	if getNodeType(node) == NODE_LEAF {
-		return *leafNodeKey(node, *leafNodeNumcells(node)-1)
+		return leafNodeKey(node, leafNodeNumcells(node)-1), nil
+	}
+	rightChild, err := getPage(pager, internalNodeRightChild(node))
+	if err != nil {
+		return 0, err
 	}
-	rightChild := getPage(pager, *internalNodeRightChild(node))
 	return getNodeMaxKey(pager, rightChild)
 }
 
+// getNodeMinKey mirrors getNodeMaxKey, descending the leftmost children to
+// the smallest key in the subtree. An empty leaf has no minimum.
+func getNodeMinKey(pager *Pager, node []byte) (uint32, error) {
+	if getNodeType(node) == NODE_LEAF {
+		if leafNodeNumcells(node) == 0 {
+			return 0, fmt.Errorf("cannot take the minimum key of an empty leaf")
+		}
+		return leafNodeKey(node, 0), nil
+	}
+	leftChildPageNum, err := internalNodeChild(node, 0)
+	if err != nil {
+		return 0, err
+	}
+	leftChild, err := getPage(pager, leftChildPageNum)
+	if err != nil {
+		return 0, err
+	}
+	return getNodeMinKey(pager, leftChild)
+}
+
 func isNodeRoot(node []byte) bool {
-	value := *(*uint8)(unsafe.Pointer(&node[IS_ROOT_OFFSET]))
-	return value != 0
+	return node[IS_ROOT_OFFSET] != 0
 }
 
 func setNodeRoot(node []byte, isRoot bool) {
@@ -471,26 +1379,42 @@ func setNodeRoot(node []byte, isRoot bool) {
 	} else {
 		value = 0
 	}
-	*(*uint8)(unsafe.Pointer(&node[IS_ROOT_OFFSET])) = value
+	node[IS_ROOT_OFFSET] = value
 }
 
 func initializeInternalNode(node []byte) {
 	setNodeType(node, NODE_INTERNAL)
 	setNodeRoot(node, false)
-	*internalNodeNumKeys(node) = 0
-	*internalNodeRightChild(node) = INVALID_PAGE_NUM
+	setInternalNodeNumKeys(node, 0)
+	setInternalNodeRightChild(node, INVALID_PAGE_NUM)
 }
 
+// updateInternalNodeKey replaces the separator for the child whose max key
+// was oldKey. The right child has no separator in this node (its max is the
+// parent's business), so when a split lands there, as it does on every
+// ascending append, there is nothing to update.
 func updateInternalNodeKey(node []byte, oldKey uint32, newKey uint32) {
 	oldChildIndex := internalNodeFindChild(node, oldKey)
-	*internalNodeKey(node, oldChildIndex) = newKey
+	if oldChildIndex == internalNodeNumKeys(node) {
+		return
+	}
+	setInternalNodeKey(node, oldChildIndex, newKey)
 }
 
-func createNewRoot(table *Table, rightChildPageNum uint32) {
-	root := getPage(table.pager, table.rootPageNum)
-	rightChild := getPage(table.pager, rightChildPageNum)
+func createNewRoot(table *Table, rightChildPageNum uint32) error {
+	root, err := getPage(table.pager, table.rootPageNum)
+	if err != nil {
+		return err
+	}
+	rightChild, err := getPage(table.pager, rightChildPageNum)
+	if err != nil {
+		return err
+	}
 	leftChildPageNum := getUnusedPageNum(table.pager)
-	leftChild := getPage(table.pager, leftChildPageNum)
+	leftChild, err := getPage(table.pager, leftChildPageNum)
+	if err != nil {
+		return err
+	}
 
 	if getNodeType(root) == NODE_INTERNAL {
 		initializeInternalNode(rightChild)
@@ -502,69 +1426,132 @@ func createNewRoot(table *Table, rightChildPageNum uint32) {
 	setNodeRoot(leftChild, false)
 
 	if getNodeType(leftChild) == NODE_INTERNAL {
-		for i := uint32(0); i < *internalNodeNumKeys(leftChild); i++ {
-			child := getPage(table.pager, *internalNodeChild(leftChild, i))
-			*nodeParent(child) = leftChildPageNum
+		for i := uint32(0); i < internalNodeNumKeys(leftChild); i++ {
+			childPageNum, err := internalNodeChild(leftChild, i)
+			if err != nil {
+				return err
+			}
+			child, err := getPage(table.pager, childPageNum)
+			if err != nil {
+				return err
+			}
+			setNodeParent(child, leftChildPageNum)
 		}
-		child := getPage(table.pager, *internalNodeRightChild(leftChild))
-		*nodeParent(child) = leftChildPageNum
+		child, err := getPage(table.pager, internalNodeRightChild(leftChild))
+		if err != nil {
+			return err
+		}
+		setNodeParent(child, leftChildPageNum)
 	}
 
 	/* Root node is a new internal node with one key and two children */
+	if table.zeroFreedCells {
+		clear(root)
+	}
 	initializeInternalNode(root)
 	setNodeRoot(root, true)
-	*internalNodeNumKeys(root) = 1
-	*internalNodeChild(root, 0) = leftChildPageNum
-	leftChildMaxKey := getNodeMaxKey(table.pager, leftChild)
-	*internalNodeKey(root, 0) = leftChildMaxKey
-	*internalNodeRightChild(root) = rightChildPageNum
-	*nodeParent(leftChild) = table.rootPageNum
-	*nodeParent(rightChild) = table.rootPageNum
+	setInternalNodeNumKeys(root, 1)
+	if err := setInternalNodeChild(root, 0, leftChildPageNum); err != nil {
+		return err
+	}
+	leftChildMaxKey, err := getNodeMaxKey(table.pager, leftChild)
+	if err != nil {
+		return err
+	}
+	setInternalNodeKey(root, 0, leftChildMaxKey)
+	setInternalNodeRightChild(root, rightChildPageNum)
+	setNodeParent(leftChild, table.rootPageNum)
+	setNodeParent(rightChild, table.rootPageNum)
+	return nil
 }
 
 type Pager struct {
-	fileDescriptor int
-	fileLength     uint32
-	numPages       uint32
-	pages          [TABLE_MAX_PAGES][]byte
+	file       *os.File
+	fileLength uint32
+	numPages   uint32
+	pages      [TABLE_MAX_PAGES][]byte
+	// Key in openPagers and the number of open Tables using this pager.
+	path string
+	refs int
+	// Optional override for getUnusedPageNum and pagesAvailable, so tests
+	// can choose which page numbers splits receive.
+	allocator pageAllocator
+}
+
+// pageAllocator hands out the pages splits write new nodes to.
+type pageAllocator interface {
+	// allocate returns a page not in use. Each page is fetched with
+	// getPage before the next one is allocated.
+	allocate(pager *Pager) uint32
+	// available returns how many more pages allocate can hand out; inserts
+	// that would need more are refused before they split anything.
+	available(pager *Pager) uint32
 }
 
-func pagerOpen(filename string) *Pager {
-	fd, err := syscall.Open(filename, syscall.O_RDWR|syscall.O_CREAT, 0600)
+// openPagers maps the absolute path of each open database file to its
+// pager, so every Table opened on the same file shares one page cache
+// rather than each overwriting the other's pages on close.
+var openPagers = map[string]*Pager{}
+
+// sharedPager returns the pager already open for filename, or opens one.
+func sharedPager(filename string, create bool) (*Pager, error) {
+	path, err := filepath.Abs(filename)
 	if err != nil {
-		fmt.Printf("Uanble to open file: %s\n", filename)
-		os.Exit(1)
+		return nil, fmt.Errorf("unable to resolve path %s: %w", filename, err)
 	}
-	fileInfo := &syscall.Stat_t{}
-	err = syscall.Stat(filename, fileInfo)
+	if pager, ok := openPagers[path]; ok {
+		pager.refs++
+		return pager, nil
+	}
+	pager, err := pagerOpen(filename, create)
 	if err != nil {
-		fmt.Println(err)
-		fmt.Printf("Unable to get file info: %s\n", filename)
-		os.Exit(1)
+		return nil, err
+	}
+	pager.path = path
+	pager.refs = 1
+	openPagers[path] = pager
+	return pager, nil
+}
+
+// pagerOpen opens the database file, creating it first if create is set.
+func pagerOpen(filename string, create bool) (*Pager, error) {
+	flags := os.O_RDWR
+	if create {
+		flags |= os.O_CREATE
+	}
+	file, err := os.OpenFile(filename, flags, 0600)
+	if err != nil {
+		return nil, fmt.Errorf("unable to open file %s: %w", filename, err)
+	}
+	fileInfo, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return nil, fmt.Errorf("unable to get file info %s: %w", filename, err)
 	}
-	fileLength := uint32(fileInfo.Size)
+	fileLength := uint32(fileInfo.Size())
 	numPages := fileLength / PAGE_SIZE
 	if fileLength%PAGE_SIZE != 0 {
 		numPages++
 	}
 
 	pager := &Pager{
-		fileDescriptor: fd,
-		fileLength:     fileLength,
-		numPages:       numPages,
+		file:       file,
+		fileLength: fileLength,
+		numPages:   numPages,
 	}
 
 	for i := 0; i < TABLE_MAX_PAGES; i++ {
 		pager.pages[i] = nil
 	}
 
-	return pager
+	return pager, nil
 }
 
-func getPage(pager *Pager, pageNum uint32) []byte {
-	if pageNum > TABLE_MAX_PAGES {
-		fmt.Printf("Page number out of bounds:%d\n", pageNum)
-		os.Exit(1)
+// getPage returns the cached copy of a page, reading it from the file on
+// first use. A page past the end of the file starts out zeroed.
+func getPage(pager *Pager, pageNum uint32) ([]byte, error) {
+	if pageNum >= TABLE_MAX_PAGES {
+		return nil, fmt.Errorf("page number out of bounds: %d", pageNum)
 	}
 
 	if pager.pages[pageNum] == nil {
@@ -577,10 +1564,10 @@ func getPage(pager *Pager, pageNum uint32) []byte {
 
 		if pageNum <= numPages {
 			offset := int64(pageNum * PAGE_SIZE)
-			_, err := syscall.Pread(pager.fileDescriptor, page, offset)
-			if err != nil {
-				fmt.Printf("Error reading file: %s\n", err)
-				os.Exit(1)
+			/* The last page may be partial; ReadAt reports the short read as io.EOF */
+			_, err := pager.file.ReadAt(page, offset)
+			if err != nil && err != io.EOF {
+				return nil, fmt.Errorf("error reading page %d: %w", pageNum, err)
 			}
 		}
 
@@ -589,128 +1576,473 @@ func getPage(pager *Pager, pageNum uint32) []byte {
 			pager.numPages = pageNum + 1
 		}
 	}
-	return pager.pages[pageNum]
+	return pager.pages[pageNum], nil
 }
 
-func pagerFlush(pager *Pager, pageNum uint32) {
+func pagerFlush(pager *Pager, pageNum uint32) error {
 	if pager.pages[pageNum] == nil {
-		fmt.Println("Tried to flush null page")
-		os.Exit(1)
+		return fmt.Errorf("tried to flush null page %d", pageNum)
 	}
 
 	offset := int64(pageNum * PAGE_SIZE)
-	_, err := syscall.Pwrite(pager.fileDescriptor, pager.pages[pageNum], offset)
-	if err != nil {
-		fmt.Printf("Error writing: %s\n", err)
-		os.Exit(1)
+	if _, err := pager.file.WriteAt(pager.pages[pageNum], offset); err != nil {
+		return fmt.Errorf("error writing page %d: %w", pageNum, err)
 	}
+	/* getPage only reads pages that lie within fileLength */
+	if end := (pageNum + 1) * PAGE_SIZE; end > pager.fileLength {
+		pager.fileLength = end
+	}
+	return nil
+}
+
+// pagesAvailable returns how many more pages getUnusedPageNum can hand out.
+func pagesAvailable(pager *Pager) uint32 {
+	if pager.allocator != nil {
+		return pager.allocator.available(pager)
+	}
+	return TABLE_MAX_PAGES - pager.numPages
 }
 
+// getUnusedPageNum returns the page a split should write its new node to:
+// the first page past the end of the file, unless an allocator is set.
 func getUnusedPageNum(pager *Pager) uint32 {
+	if pager.allocator != nil {
+		return pager.allocator.allocate(pager)
+	}
 	return pager.numPages
 }
 
-func dbClose(table *Table) {
+// dbClose writes the table's cached pages to disk. The file is closed and
+// the cache dropped only once the last Table sharing the pager is closed.
+func dbClose(table *Table) error {
 	pager := table.pager
 
+	var err error
 	for i := uint32(0); i < pager.numPages; i++ {
 		if pager.pages[i] == nil {
 			continue
 		}
-		pagerFlush(pager, i)
-		pager.pages[i] = nil
+		if flushErr := pagerFlush(pager, i); flushErr != nil && err == nil {
+			err = flushErr
+		}
 	}
 
-	syscall.Close(pager.fileDescriptor)
+	pager.refs--
+	if pager.refs > 0 {
+		return err
+	}
+	delete(openPagers, pager.path)
+	if closeErr := pager.file.Close(); closeErr != nil && err == nil {
+		err = closeErr
+	}
 	for i := uint32(0); i < TABLE_MAX_PAGES; i++ {
 		if pager.pages[i] != nil {
 			pager.pages[i] = nil
 		}
 	}
+	return err
+}
+
+// dbCheckpoint writes every cached page back to the file and fsyncs it,
+// leaving the table open. Rows inserted before a checkpoint survive a
+// crash afterwards; there is no dirty tracking, so every cached page is
+// written.
+func dbCheckpoint(table *Table) error {
+	pager := table.pager
+	for i := uint32(0); i < pager.numPages; i++ {
+		if pager.pages[i] == nil {
+			continue
+		}
+		if err := pagerFlush(pager, i); err != nil {
+			return err
+		}
+	}
+	if err := pager.file.Sync(); err != nil {
+		return fmt.Errorf("unable to sync database file: %w", err)
+	}
+	return nil
+}
+
+// dbFork copies the database as it stands, cached changes included, into a
+// new file that can then be opened and changed independently. It will not
+// overwrite an existing file, and removes its partial copy if it fails.
+func dbFork(table *Table, filename string) (err error) {
+	file, err := os.OpenFile(filename, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if closeErr := file.Close(); closeErr != nil && err == nil {
+			err = closeErr
+		}
+		/* A truncated fork would block every retry under the same name */
+		if err != nil {
+			os.Remove(filename)
+		}
+	}()
+	pager := table.pager
+	for i := uint32(0); i < pager.numPages; i++ {
+		page, err := getPage(pager, i)
+		if err != nil {
+			return err
+		}
+		if _, err := file.WriteAt(page, int64(i)*PAGE_SIZE); err != nil {
+			return err
+		}
+	}
+	return file.Sync()
 }
 
-func dbOpen(filename string) *Table {
-	pager := pagerOpen(filename)
+// dbOpen opens the database in filename, creating an empty one if the file
+// does not exist yet.
+func dbOpen(filename string) (*Table, error) {
+	return dbOpenFile(filename, true)
+}
+
+// dbOpenExisting is like dbOpen but fails if filename does not exist, so a
+// mistyped path is reported rather than silently creating a new database.
+func dbOpenExisting(filename string) (*Table, error) {
+	return dbOpenFile(filename, false)
+}
+
+func dbOpenFile(filename string, create bool) (*Table, error) {
+	pager, err := sharedPager(filename, create)
+	if err != nil {
+		return nil, err
+	}
 
 	table := &Table{
-		pager:       pager,
-		rootPageNum: 0,
+		pager:                pager,
+		rootPageNum:          0,
+		leafNodeMaxCells:     uint32(LEAF_NODE_MAX_CELLS),
+		internalNodeMaxCells: INTERNAL_NODE_MAX_CELLS,
 	}
 
-	if pager.numPages == 0 {
-		rootNode := getPage(pager, 0)
+	newFile := pager.numPages == 0
+	rootNode, err := getPage(pager, 0)
+	if err != nil {
+		dbClose(table)
+		return nil, err
+	}
+	if newFile {
 		initializeLeafNode(rootNode)
+		setNodeRoot(rootNode, true)
+	}
+	/* Files from before the root page was flagged lay out leaves differently */
+	if !isNodeRoot(rootNode) {
+		if !upgradeOldRoot(table, rootNode) {
+			dbClose(table)
+			return nil, fmt.Errorf("%s uses an older page format that this version cannot read", filename)
+		}
 	}
 
-	return table
+	return table, nil
+}
+
+// OLD_LEAF_NODE_HEADER_SIZE is the leaf header of the format before the
+// next-leaf pointer got its own field, when cells started right after the
+// cell count.
+const OLD_LEAF_NODE_HEADER_SIZE = COMMON_NODE_HEADER_SIZE + LEAF_NODE_NUM_CELLS_SIZE
+
+// upgradeOldRoot rewrites a root page left by the older format in place.
+// That format never split a leaf, so the root is the only page in use: its
+// cells move up past the next-leaf field, which is cleared, and the page is
+// flagged as the root. Any later pages were never linked into the tree and
+// stay unused. The upgraded page reaches the file on the next flush. It
+// reports false, leaving the page alone, if node cannot be such a root.
+func upgradeOldRoot(table *Table, node []byte) bool {
+	if getNodeType(node) != NODE_LEAF {
+		return false
+	}
+	numCells := leafNodeNumcells(node)
+	if numCells > table.leafNodeMaxCells {
+		return false
+	}
+	cells := node[OLD_LEAF_NODE_HEADER_SIZE : OLD_LEAF_NODE_HEADER_SIZE+numCells*uint32(LEAF_NODE_CELL_SIZE)]
+	copy(node[LEAF_NODE_HEADER_SIZE:], cells)
+	setLeafNodeNextLeaf(node, 0)
+	setNodeRoot(node, true)
+	return true
 }
 
 type Table struct {
 	rootPageNum uint32
 	pager       *Pager
+	// Fan-out limits for this table. dbOpen derives them from PAGE_SIZE;
+	// tests may lower them on a fresh table to force multi-level splits
+	// with only a handful of rows. They must never be lowered below the
+	// fill of a node that already holds data.
+	leafNodeMaxCells     uint32
+	internalNodeMaxCells uint32
+	duplicatePolicy      DuplicatePolicy
+	// Zero the cell slots a split, delete or borrow moves rows out of, and
+	// the pages a merge or a shrinking root drops, rather than leaving old
+	// bytes behind.
+	zeroFreedCells bool
 }
 
+// serializeRow writes source into a row slot. The text columns are fixed
+// width and NUL padded; a value may fill its column exactly, in which case
+// no terminator is stored. deserializeRow strips only the padding, so any
+// value that passed prepareInsert's length checks reads back unchanged.
 func serializeRow(source *Row, destination []byte) {
 	binary.LittleEndian.PutUint32(destination[ID_OFFSET:], source.id)
-	copy(destination[USERNAME_OFFSET:], []byte(source.username))
-	copy(destination[EMAIL_OFFSET:], []byte(source.email))
+	/* Clear the fixed-width columns so an overwritten value leaves no tail */
+	username := destination[USERNAME_OFFSET : USERNAME_OFFSET+USERNAME_SIZE]
+	clear(username)
+	copy(username, source.username)
+	email := destination[EMAIL_OFFSET : EMAIL_OFFSET+EMAIL_SIZE]
+	clear(email)
+	copy(email, source.email)
 }
 
 func deserializeRow(destination *Row, source []byte) {
 	destination.id = binary.LittleEndian.Uint32(source[ID_OFFSET:])
-	destination.username = string(source[USERNAME_OFFSET : USERNAME_OFFSET+USERNAME_SIZE])
-	destination.email = string(source[EMAIL_OFFSET : EMAIL_OFFSET+EMAIL_SIZE])
+	destination.username = strings.TrimRight(string(source[USERNAME_OFFSET:USERNAME_OFFSET+USERNAME_SIZE]), "\x00")
+	destination.email = strings.TrimRight(string(source[EMAIL_OFFSET:EMAIL_OFFSET+EMAIL_SIZE]), "\x00")
 }
 
-func cursorValue(cursor *Cursor) []byte {
-	node := getPage(cursor.table.pager, cursor.pageNum)
-	return leafNodeValue(node, cursor.cellNum)
-}
+func cursorValue(cursor *Cursor) ([]byte, error) {
+	node, err := getPage(cursor.table.pager, cursor.pageNum)
+	if err != nil {
+		return nil, err
+	}
+	return leafNodeValue(node, cursor.cellNum), nil
+}
 
-func cursorAdvance(cursor *Cursor) {
-	node := getPage(cursor.table.pager, cursor.pageNum)
+func cursorAdvance(cursor *Cursor) error {
+	node, err := getPage(cursor.table.pager, cursor.pageNum)
+	if err != nil {
+		return err
+	}
 	cursor.cellNum++
-	if cursor.cellNum >= *leafNodeNumcells(node) {
-		nextPageNum := *leafNodeNextLeaf(node)
-		if nextPageNum == 0 {
-			cursor.endOfTable = true
-		} else {
-			cursor.pageNum = nextPageNum
-			cursor.cellNum = 0
-		}
+	if cursor.cellNum >= leafNodeNumcells(node) {
+		return cursorNextLeaf(cursor, node)
+	}
+	return nil
+}
+
+// cursorNextLeaf moves the cursor to the first cell of the leaf after node,
+// or marks the end of the table when node is the last leaf.
+func cursorNextLeaf(cursor *Cursor, node []byte) error {
+	nextPageNum := leafNodeNextLeaf(node)
+	if nextPageNum == 0 {
+		cursor.endOfTable = true
+		return nil
+	}
+	if cursor.visited == nil {
+		cursor.visited = map[uint32]bool{cursor.pageNum: true}
+	}
+	if cursor.visited[nextPageNum] {
+		return fmt.Errorf("cycle in leaf chain: page %d links back to page %d", cursor.pageNum, nextPageNum)
+	}
+	cursor.visited[nextPageNum] = true
+	cursor.pageNum = nextPageNum
+	cursor.cellNum = 0
+	return nil
+}
 
+func cursorKey(cursor *Cursor) (uint32, error) {
+	node, err := getPage(cursor.table.pager, cursor.pageNum)
+	if err != nil {
+		return 0, err
+	}
+	return leafNodeKey(node, cursor.cellNum), nil
+}
+
+// tableSeek returns a cursor at the first row whose key is >= key, moving
+// on to the next leaf when tableFind lands past the last cell of a leaf.
+func tableSeek(table *Table, key uint32) (*Cursor, error) {
+	cursor, err := tableFind(table, key)
+	if err != nil {
+		return nil, err
+	}
+	node, err := getPage(table.pager, cursor.pageNum)
+	if err != nil {
+		return nil, err
+	}
+	for !cursor.endOfTable && cursor.cellNum >= leafNodeNumcells(node) {
+		if err := cursorNextLeaf(cursor, node); err != nil {
+			return nil, err
+		}
+		node, err = getPage(table.pager, cursor.pageNum)
+		if err != nil {
+			return nil, err
+		}
 	}
+	return cursor, nil
 }
 
-func tableStart(table *Table) *Cursor {
-	cursor := tableFind(table, 0)
-	node := getPage(cursor.table.pager, cursor.pageNum)
-	numCells := *leafNodeNumcells(node)
+// tableStart returns a cursor at the smallest key. Searching for key 0 is
+// safe even when 0 is a stored id: the search lands on the first cell
+// whose key is >= 0, which is the first cell of the leftmost leaf either way.
+func tableStart(table *Table) (*Cursor, error) {
+	cursor, err := tableFind(table, 0)
+	if err != nil {
+		return nil, err
+	}
+	node, err := getPage(cursor.table.pager, cursor.pageNum)
+	if err != nil {
+		return nil, err
+	}
+	numCells := leafNodeNumcells(node)
 	cursor.endOfTable = (numCells == 0)
-	return cursor
+	return cursor, nil
+}
+
+// tableKeys returns every key in ascending order. It walks the leaf chain
+// reading only the cell keys, without deserializing any row.
+func tableKeys(table *Table) ([]uint32, error) {
+	cursor, err := tableStart(table)
+	if err != nil {
+		return nil, err
+	}
+	var keys []uint32
+	for !cursor.endOfTable {
+		node, err := getPage(table.pager, cursor.pageNum)
+		if err != nil {
+			return nil, err
+		}
+		numCells := leafNodeNumcells(node)
+		for i := uint32(0); i < numCells; i++ {
+			keys = append(keys, leafNodeKey(node, i))
+		}
+		if err := cursorNextLeaf(cursor, node); err != nil {
+			return nil, err
+		}
+	}
+	return keys, nil
+}
+
+// tableRangeKeys returns the keys from lo up to hi in ascending order, or
+// up to but not including hi when inclusive is false. Like tableKeys it
+// reads only cell keys, starting from a seek to lo rather than a full scan.
+func tableRangeKeys(table *Table, lo uint32, hi uint32, inclusive bool) ([]uint32, error) {
+	if lo > hi || (lo == hi && !inclusive) {
+		return nil, nil
+	}
+	cursor, err := tableSeek(table, lo)
+	if err != nil {
+		return nil, err
+	}
+	var keys []uint32
+	for !cursor.endOfTable {
+		key, err := cursorKey(cursor)
+		if err != nil {
+			return nil, err
+		}
+		if key > hi || (key == hi && !inclusive) {
+			break
+		}
+		keys = append(keys, key)
+		if err := cursorAdvance(cursor); err != nil {
+			return nil, err
+		}
+	}
+	return keys, nil
+}
+
+// tableScanReverse calls visit for each cell from the highest key down,
+// stopping as soon as visit returns false. Children are entered right to
+// left, so reading the last few rows touches only the pages that hold them.
+func tableScanReverse(table *Table, visit func(pageNum uint32, node []byte, cellNum uint32) bool) error {
+	_, err := scanNodeReverse(table.pager, table.rootPageNum, map[uint32]bool{}, visit)
+	return err
+}
+
+// scanNodeReverse scans the subtree at pageNum for tableScanReverse and
+// reports whether the scan should go on to the subtree's left sibling.
+func scanNodeReverse(pager *Pager, pageNum uint32, visited map[uint32]bool, visit func(pageNum uint32, node []byte, cellNum uint32) bool) (bool, error) {
+	if visited[pageNum] {
+		return false, fmt.Errorf("cycle in tree: page %d reached twice", pageNum)
+	}
+	visited[pageNum] = true
+	node, err := getPage(pager, pageNum)
+	if err != nil {
+		return false, err
+	}
+
+	if getNodeType(node) == NODE_LEAF {
+		for i := leafNodeNumcells(node); i > 0; i-- {
+			if !visit(pageNum, node, i-1) {
+				return false, nil
+			}
+		}
+		return true, nil
+	}
+	for i := internalNodeNumKeys(node) + 1; i > 0; i-- {
+		child, err := internalNodeChild(node, i-1)
+		if err != nil {
+			return false, err
+		}
+		more, err := scanNodeReverse(pager, child, visited, visit)
+		if err != nil || !more {
+			return false, err
+		}
+	}
+	return true, nil
+}
+
+// tableEnd returns a cursor one past the last row, found by following right
+// children down from the root rather than searching for a key.
+func tableEnd(table *Table) (*Cursor, error) {
+	visited := map[uint32]bool{}
+	pageNum := table.rootPageNum
+	node, err := getPage(table.pager, pageNum)
+	if err != nil {
+		return nil, err
+	}
+	for getNodeType(node) == NODE_INTERNAL {
+		if visited[pageNum] {
+			return nil, fmt.Errorf("cycle in tree: page %d is its own ancestor", pageNum)
+		}
+		visited[pageNum] = true
+		pageNum = internalNodeRightChild(node)
+		node, err = getPage(table.pager, pageNum)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return &Cursor{
+		table:      table,
+		pageNum:    pageNum,
+		cellNum:    leafNodeNumcells(node),
+		endOfTable: true,
+	}, nil
 }
 
-func tableFind(table *Table, key uint32) *Cursor {
+func tableFind(table *Table, key uint32) (*Cursor, error) {
 	rootPageNum := table.rootPageNum
-	rootNode := getPage(table.pager, rootPageNum)
+	rootNode, err := getPage(table.pager, rootPageNum)
+	if err != nil {
+		return nil, err
+	}
 	if getNodeType(rootNode) == NODE_LEAF {
 		return leafNodeFind(table, rootPageNum, key)
-	} else {
-		return internalNodeFind(table, key, rootPageNum)
 	}
-	return nil
+	return internalNodeFind(table, key, rootPageNum, map[uint32]bool{})
 }
 
-func internalNodeFind(table *Table, key uint32, pageNum uint32) *Cursor {
-	node := getPage(table.pager, pageNum)
-	numKeys := *internalNodeNumKeys(node)
+// internalNodeFind descends from pageNum to the leaf that should hold key.
+// visited holds the pages already on the path; a child pointing back at one
+// of them is a cycle and is reported rather than followed.
+func internalNodeFind(table *Table, key uint32, pageNum uint32, visited map[uint32]bool) (*Cursor, error) {
+	if visited[pageNum] {
+		return nil, fmt.Errorf("cycle in tree: page %d is its own ancestor", pageNum)
+	}
+	visited[pageNum] = true
+	node, err := getPage(table.pager, pageNum)
+	if err != nil {
+		return nil, err
+	}
+	numKeys := internalNodeNumKeys(node)
 
 	minIndex := uint32(0)
 	maxIndex := numKeys
 
 	for minIndex != maxIndex {
 		index := (minIndex + maxIndex) / 2
-		keyToRight := *internalNodeKey(node, index)
+		keyToRight := internalNodeKey(node, index)
 		if keyToRight >= key {
 			maxIndex = index
 		} else {
@@ -718,59 +2050,484 @@ func internalNodeFind(table *Table, key uint32, pageNum uint32) *Cursor {
 		}
 	}
 
-	childNum := *internalNodeChild(node, minIndex)
-	child := getPage(table.pager, childNum)
+	childNum, err := internalNodeChild(node, minIndex)
+	if err != nil {
+		return nil, err
+	}
+	child, err := getPage(table.pager, childNum)
+	if err != nil {
+		return nil, err
+	}
 
 	switch getNodeType(child) {
 	case NODE_INTERNAL:
-		return internalNodeFind(table, key, childNum)
+		return internalNodeFind(table, key, childNum, visited)
 	case NODE_LEAF:
 		return leafNodeFind(table, childNum, key)
 	}
-	return nil
+	return nil, fmt.Errorf("page %d has unknown node type %d", childNum, getNodeType(child))
 }
 
 type InputBuffer struct {
 	buffer       string
 	bufferLength int
 	inputLength  int
+	reader       *bufio.Reader
+}
+
+// Session holds the open database and the REPL settings changed by meta
+// commands.
+type Session struct {
+	// The database statements run against; .open replaces it.
+	table *Table
+	// Set by -existing: .open, like the database named on the command
+	// line, refuses a file that is not already there.
+	existingOnly bool
+	outputMode   OutputMode
+	nulDisplay   NulDisplay
+	prompt       string
+	// Most rows a select prints before cutting off with a notice; 0 means
+	// no cap. This only guards the terminal, the scan itself is unchanged.
+	rowLimit           int
+	maxStatementLength int
+	// Inserts append to the rightmost leaf without a lookup or duplicate
+	// check, for loading sorted data. A key that does not increase fails.
+	fastload bool
+}
+
+func newSession() *Session {
+	return &Session{
+		outputMode:         OUTPUT_MODE_LIST,
+		prompt:             DEFAULT_PROMPT,
+		maxStatementLength: DEFAULT_MAX_STATEMENT_LENGTH,
+	}
 }
 
 func newInputBuffer() *InputBuffer {
-	return &InputBuffer{}
+	return &InputBuffer{
+		reader: bufio.NewReader(os.Stdin),
+	}
+}
+
+const DEFAULT_PROMPT = "tinySQL > "
+
+// Longest input line, in bytes, that is parsed; anything longer is
+// rejected before it reaches the tokenizer.
+const DEFAULT_MAX_STATEMENT_LENGTH = 1 << 20
+
+// defaultPrompt is the prompt used when no -prompt flag is given: the
+// TINYSQL_PROMPT environment variable if set, else DEFAULT_PROMPT.
+func defaultPrompt() string {
+	if prompt, ok := os.LookupEnv("TINYSQL_PROMPT"); ok {
+		return prompt
+	}
+	return DEFAULT_PROMPT
+}
+
+func printPrompt(session *Session) {
+	fmt.Print(session.prompt)
+}
+
+// printBanner greets an interactive user with the database in use.
+func printBanner(filename string) {
+	fmt.Printf("tinySQL, connected to %s. Enter \".exit\" to quit.\n", filename)
+}
+
+func isTerminal(file *os.File) bool {
+	info, err := file.Stat()
+	return err == nil && info.Mode()&os.ModeCharDevice != 0
+}
+
+// readInput reads the next line into inputBuffer. It returns io.EOF once
+// the input is exhausted; a final line without a trailing newline is still
+// returned normally. At most limit+1 bytes of a line are kept: the rest of
+// a longer one is read and dropped, and bufferLength still counts the whole
+// line so processInput can reject it.
+func readInput(inputBuffer *InputBuffer, limit int) error {
+	var line []byte
+	length := 0
+	for {
+		chunk, err := inputBuffer.reader.ReadSlice('\n')
+		length += len(chunk)
+		if room := limit + 1 - len(line); room > 0 {
+			line = append(line, chunk[:min(len(chunk), room)]...)
+		}
+		if err == bufio.ErrBufferFull {
+			continue
+		}
+		if err != nil && !(err == io.EOF && length > 0) {
+			return err
+		}
+		if err == nil {
+			/* Drop the newline from the count and, if it was kept, the line */
+			length--
+			line = bytes.TrimSuffix(line, []byte("\n"))
+		}
+		break
+	}
+	inputBuffer.bufferLength = length
+	if length > limit {
+		inputBuffer.buffer = string(line)
+		return nil
+	}
+	inputBuffer.buffer = normalizeInput(string(line))
+	return nil
 }
 
-func printPrompt() {
-	fmt.Print("tinySQL >")
+// normalizeInput trims surrounding whitespace and any terminating
+// semicolons, which carry no meaning, and blanks out comment lines.
+func normalizeInput(line string) string {
+	line = strings.TrimSpace(line)
+	/* Whole-line comments are treated like blank lines */
+	if strings.HasPrefix(line, "--") {
+		return ""
+	}
+	return strings.TrimSpace(strings.TrimRight(line, ";"))
+}
+
+// gzipFile is a gzip compressed file being read; closing it closes the
+// file as well as the decompressor.
+type gzipFile struct {
+	*gzip.Reader
+	file *os.File
+}
+
+func (g *gzipFile) Close() error {
+	err := g.Reader.Close()
+	if closeErr := g.file.Close(); err == nil {
+		err = closeErr
+	}
+	return err
 }
 
-func readInput(inputBuffer *InputBuffer) {
-	reader := bufio.NewReader(os.Stdin)
-	buffer, err := reader.ReadString('\n')
+// openScript opens the script at filename for reading. A name ending in .gz
+// is decompressed as it is read.
+func openScript(filename string) (io.ReadCloser, error) {
+	file, err := os.Open(filename)
 	if err != nil {
-		fmt.Println("Error reading input")
-		os.Exit(1)
+		return nil, err
+	}
+	if !strings.HasSuffix(filename, ".gz") {
+		return file, nil
+	}
+	gzipReader, err := gzip.NewReader(file)
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	return &gzipFile{Reader: gzipReader, file: file}, nil
+}
+
+// runScript feeds each line of the script at filename to processInput, as
+// if it had been typed at the prompt.
+func runScript(filename string, session *Session) error {
+	reader, err := openScript(filename)
+	if err != nil {
+		return err
+	}
+	defer reader.Close()
+
+	scanner := bufio.NewScanner(reader)
+	/* Room for the longest statement allowed plus its line ending */
+	scanner.Buffer(nil, session.maxStatementLength+2)
+	for scanner.Scan() {
+		inputBuffer := &InputBuffer{buffer: normalizeInput(scanner.Text())}
+		processInput(inputBuffer, session)
+	}
+	if scanner.Err() == bufio.ErrTooLong {
+		return fmt.Errorf("statement too large, the limit is %d bytes", session.maxStatementLength)
 	}
-	inputBuffer.bufferLength = len(buffer) - 1
-	buffer = strings.TrimSpace(buffer)
-	inputBuffer.buffer = buffer
+	return scanner.Err()
 }
 
-func doMetaCommand(inputBuffer *InputBuffer, table *Table) MetaCommandResult {
+// doKeysCommand handles ".keys", listing every key, and ".keys LO HI",
+// listing the keys from LO to HI inclusive.
+func doKeysCommand(parts []string, table *Table) (MetaCommandResult, error) {
+	var keys []uint32
+	var err error
+	switch len(parts) {
+	case 1:
+		keys, err = tableKeys(table)
+	case 3:
+		lo, loErr := strconv.ParseUint(parts[1], 10, 32)
+		hi, hiErr := strconv.ParseUint(parts[2], 10, 32)
+		if loErr != nil || hiErr != nil {
+			return META_COMMAND_SUCCESS, fmt.Errorf("invalid key range: %s %s", parts[1], parts[2])
+		}
+		keys, err = tableRangeKeys(table, uint32(lo), uint32(hi), true)
+	default:
+		return META_COMMAND_SUCCESS, fmt.Errorf("usage: .keys [LO HI]")
+	}
+	if err != nil {
+		return META_COMMAND_SUCCESS, err
+	}
+	for _, key := range keys {
+		fmt.Println(key)
+	}
+	return META_COMMAND_SUCCESS, nil
+}
+
+func doMetaCommand(inputBuffer *InputBuffer, session *Session) (MetaCommandResult, error) {
+	table := session.table
+	parts := strings.Fields(inputBuffer.buffer)
+	switch parts[0] {
+	case ".open":
+		return doOpenCommand(parts, session)
+	case ".mode":
+		return doModeCommand(parts, session)
+	case ".limit":
+		return doLimitCommand(parts, session)
+	case ".nul":
+		return doNulCommand(parts, session)
+	case ".page":
+		if len(parts) != 2 {
+			return META_COMMAND_SUCCESS, fmt.Errorf("usage: .page N")
+		}
+		pageNum, err := strconv.ParseUint(parts[1], 10, 32)
+		if err != nil {
+			return META_COMMAND_SUCCESS, fmt.Errorf("invalid page number: %s", parts[1])
+		}
+		return META_COMMAND_SUCCESS, printPage(table.pager, uint32(pageNum))
+	case ".dot":
+		return doDotCommand(parts, table)
+	case ".dump":
+		return doDumpCommand(parts, table)
+	case ".fork":
+		if len(parts) != 2 {
+			return META_COMMAND_SUCCESS, fmt.Errorf("usage: .fork FILE")
+		}
+		return META_COMMAND_SUCCESS, dbFork(table, parts[1])
+	case ".seed":
+		return doSeedCommand(parts, table)
+	case ".fastload":
+		return doFastloadCommand(parts, session)
+	case ".keys":
+		return doKeysCommand(parts, table)
+	}
+
 	switch inputBuffer.buffer {
 	case ".exit":
-		dbClose(table)
+		if err := dbClose(table); err != nil {
+			fmt.Printf("Error: %s\n", err)
+			os.Exit(1)
+		}
 		os.Exit(0)
 	case ".btree":
 		fmt.Println("Tree:")
-		printTree(table.pager, 0, 0)
-		return META_COMMAND_SUCCESS
+		return META_COMMAND_SUCCESS, printTree(table.pager, 0, 0, map[uint32]bool{})
+	case ".stats":
+		stats, err := treeStats(table)
+		if err != nil {
+			return META_COMMAND_SUCCESS, err
+		}
+		printTreeStats(stats)
+		return META_COMMAND_SUCCESS, nil
+	case ".relink":
+		return META_COMMAND_SUCCESS, relinkLeaves(table)
+	case ".databases":
+		fmt.Printf("main: %s\n", table.pager.path)
+		return META_COMMAND_SUCCESS, nil
+	case ".checkpoint":
+		return META_COMMAND_SUCCESS, dbCheckpoint(table)
+	case ".check":
+		if err := checkTree(table); err != nil {
+			return META_COMMAND_SUCCESS, err
+		}
+		fmt.Println("Tree OK.")
+		return META_COMMAND_SUCCESS, nil
 	case ".constants":
 		fmt.Println("Constants:")
 		printConstant()
-		return META_COMMAND_SUCCESS
+		return META_COMMAND_SUCCESS, nil
+	}
+	return META_UNRECOGNISED_COMMAND, nil
+}
+
+func doModeCommand(parts []string, session *Session) (MetaCommandResult, error) {
+	if len(parts) != 2 {
+		return META_COMMAND_SUCCESS, fmt.Errorf("usage: .mode list|insert")
+	}
+	switch parts[1] {
+	case "list":
+		session.outputMode = OUTPUT_MODE_LIST
+	case "insert":
+		session.outputMode = OUTPUT_MODE_INSERT
+	default:
+		return META_COMMAND_SUCCESS, fmt.Errorf("unknown mode: %s", parts[1])
+	}
+	return META_COMMAND_SUCCESS, nil
+}
+
+// doOpenCommand closes the current database and opens another in its place,
+// keeping the insert options given on the command line, -existing
+// included. If the new file cannot be opened the current database stays
+// open.
+func doOpenCommand(parts []string, session *Session) (MetaCommandResult, error) {
+	if len(parts) != 2 {
+		return META_COMMAND_SUCCESS, fmt.Errorf("usage: .open FILE")
+	}
+	open := dbOpen
+	if session.existingOnly {
+		open = dbOpenExisting
+	}
+	table, err := open(parts[1])
+	if err != nil {
+		return META_COMMAND_SUCCESS, err
+	}
+	table.duplicatePolicy = session.table.duplicatePolicy
+	table.zeroFreedCells = session.table.zeroFreedCells
+	err = dbClose(session.table)
+	session.table = table
+	return META_COMMAND_SUCCESS, err
+}
+
+// doDumpCommand writes the table as insert statements, to stdout or to a
+// file given as the argument. A file name ending in .gz is gzip compressed
+// as it is written.
+func doDumpCommand(parts []string, table *Table) (MetaCommandResult, error) {
+	switch len(parts) {
+	case 1:
+		return META_COMMAND_SUCCESS, writeDump(os.Stdout, table)
+	case 2:
+	default:
+		return META_COMMAND_SUCCESS, fmt.Errorf("usage: .dump [FILE]")
+	}
+
+	file, err := os.Create(parts[1])
+	if err != nil {
+		return META_COMMAND_SUCCESS, err
+	}
+	if !strings.HasSuffix(parts[1], ".gz") {
+		if err := writeDump(file, table); err != nil {
+			file.Close()
+			return META_COMMAND_SUCCESS, err
+		}
+		return META_COMMAND_SUCCESS, file.Close()
+	}
+
+	gzipWriter := gzip.NewWriter(file)
+	if err := writeDump(gzipWriter, table); err != nil {
+		file.Close()
+		return META_COMMAND_SUCCESS, err
+	}
+	if err := gzipWriter.Close(); err != nil {
+		file.Close()
+		return META_COMMAND_SUCCESS, err
+	}
+	return META_COMMAND_SUCCESS, file.Close()
+}
+
+// writeDump writes one insert statement per row, in id order, in the same
+// form as .mode insert; running the output as a script rebuilds the table.
+func writeDump(w io.Writer, table *Table) error {
+	cursor, err := tableStart(table)
+	if err != nil {
+		return err
+	}
+	bufferedWriter := bufio.NewWriter(w)
+	var row Row
+	for !cursor.endOfTable {
+		value, err := cursorValue(cursor)
+		if err != nil {
+			return err
+		}
+		deserializeRow(&row, value)
+		fmt.Fprintf(bufferedWriter, "insert %d %s %s\n", row.id, row.username, row.email)
+		if err := cursorAdvance(cursor); err != nil {
+			return err
+		}
+	}
+	return bufferedWriter.Flush()
+}
+
+// doSeedCommand inserts rows 1..n with generated usernames and emails and
+// reports how long it took. Ids that already exist go through the table's
+// duplicate policy like any other insert.
+func doSeedCommand(parts []string, table *Table) (MetaCommandResult, error) {
+	if len(parts) != 2 {
+		return META_COMMAND_SUCCESS, fmt.Errorf("usage: .seed N")
+	}
+	n, err := strconv.ParseUint(parts[1], 10, 32)
+	if err != nil {
+		return META_COMMAND_SUCCESS, fmt.Errorf("invalid row count: %s", parts[1])
+	}
+
+	start := time.Now()
+	inserted, duplicates := 0, 0
+	for id := uint32(1); uint64(id) <= n; id++ {
+		statement := &Statement{typ: STATEMENT_INSERT}
+		statement.rowToInsert = Row{
+			id:       id,
+			username: fmt.Sprintf("user%d", id),
+			email:    fmt.Sprintf("user%d@example.com", id),
+		}
+		result, err := executeInsert(statement, table)
+		if err != nil {
+			return META_COMMAND_SUCCESS, err
+		}
+		switch result {
+		case EXECUTE_DUPLICATE_KEY:
+			duplicates++
+		case EXECUTE_TABLE_FULL:
+			return META_COMMAND_SUCCESS, fmt.Errorf("table full after %d rows", inserted)
+		default:
+			inserted++
+		}
+	}
+	fmt.Printf("seeded %d rows in %s, %d ids already existed\n", inserted, time.Since(start), duplicates)
+	return META_COMMAND_SUCCESS, nil
+}
+
+func doDotCommand(parts []string, table *Table) (MetaCommandResult, error) {
+	if len(parts) != 2 {
+		return META_COMMAND_SUCCESS, fmt.Errorf("usage: .dot FILE")
+	}
+	file, err := os.Create(parts[1])
+	if err != nil {
+		return META_COMMAND_SUCCESS, err
+	}
+	if err := writeDot(file, table.pager); err != nil {
+		file.Close()
+		return META_COMMAND_SUCCESS, err
+	}
+	return META_COMMAND_SUCCESS, file.Close()
+}
+
+func doFastloadCommand(parts []string, session *Session) (MetaCommandResult, error) {
+	if len(parts) != 2 || (parts[1] != "on" && parts[1] != "off") {
+		return META_COMMAND_SUCCESS, fmt.Errorf("usage: .fastload on|off")
+	}
+	session.fastload = parts[1] == "on"
+	return META_COMMAND_SUCCESS, nil
+}
+
+func doNulCommand(parts []string, session *Session) (MetaCommandResult, error) {
+	if len(parts) != 2 {
+		return META_COMMAND_SUCCESS, fmt.Errorf("usage: .nul trimmed|raw|escaped")
 	}
-	return META_UNRECOGNISED_COMMAND
+	switch parts[1] {
+	case "trimmed":
+		session.nulDisplay = NUL_DISPLAY_TRIMMED
+	case "raw":
+		session.nulDisplay = NUL_DISPLAY_RAW
+	case "escaped":
+		session.nulDisplay = NUL_DISPLAY_ESCAPED
+	default:
+		return META_COMMAND_SUCCESS, fmt.Errorf("unknown nul display: %s", parts[1])
+	}
+	return META_COMMAND_SUCCESS, nil
+}
+
+func doLimitCommand(parts []string, session *Session) (MetaCommandResult, error) {
+	if len(parts) != 2 {
+		return META_COMMAND_SUCCESS, fmt.Errorf("usage: .limit N (0 for no limit)")
+	}
+	limit, err := strconv.Atoi(parts[1])
+	if err != nil || limit < 0 {
+		return META_COMMAND_SUCCESS, fmt.Errorf("invalid limit: %s", parts[1])
+	}
+	session.rowLimit = limit
+	return META_COMMAND_SUCCESS, nil
 }
 
 func prepareInsert(inputBuffer *InputBuffer, statement *Statement) PrepareResult {
@@ -780,7 +2537,12 @@ func prepareInsert(inputBuffer *InputBuffer, statement *Statement) PrepareResult
 	}
 
 	if len(parts) > 4 {
-		return PREPARE_SYNTAX_TOO_LONG
+		return PREPARE_TOO_MANY_VALUES
+	}
+
+	/* id is the primary key, so it can never be NULL */
+	if strings.EqualFold(parts[1], "null") {
+		return PREPARE_NULL_ID
 	}
 
 	id, err := strconv.Atoi(parts[1])
@@ -792,11 +2554,11 @@ func prepareInsert(inputBuffer *InputBuffer, statement *Statement) PrepareResult
 	email := parts[3]
 
 	if len(username) > COLUMN_USERNAME_SIZE {
-		return PREPARE_SYNTAX_TOO_LONG
+		return PREPARE_STRING_TOO_LONG
 	}
 
 	if len(email) > COLUMN_EMAIL_SIZE {
-		return PREPARE_SYNTAX_TOO_LONG
+		return PREPARE_STRING_TOO_LONG
 	}
 
 	statement.typ = STATEMENT_INSERT
@@ -807,121 +2569,994 @@ func prepareInsert(inputBuffer *InputBuffer, statement *Statement) PrepareResult
 	return PREPARE_SUCCESS
 }
 
-func prepareStatement(inputBuffer *InputBuffer, statement *Statement) PrepareResult {
-	if strings.HasPrefix(inputBuffer.buffer, "insert") {
-		return prepareInsert(inputBuffer, statement)
-	}
-	if strings.HasPrefix(inputBuffer.buffer, "select") {
-		statement.typ = STATEMENT_SELECT
-		return PREPARE_SUCCESS
+// tokenize splits a statement into words and operator symbols, so that
+// "id>=5" and "id >= 5" read the same.
+func tokenize(input string) []string {
+	var tokens []string
+	for i := 0; i < len(input); {
+		c := input[i]
+		switch {
+		case c == ' ' || c == '\t':
+			i++
+		case strings.IndexByte("<>=!", c) >= 0:
+			if i+1 < len(input) && input[i+1] == '=' || c == '<' && i+1 < len(input) && input[i+1] == '>' {
+				tokens = append(tokens, input[i:i+2])
+				i += 2
+			} else {
+				tokens = append(tokens, input[i:i+1])
+				i++
+			}
+		case strings.IndexByte(",*()+-", c) >= 0:
+			tokens = append(tokens, input[i:i+1])
+			i++
+		case c == '\'':
+			/* A quoted string is one token, quotes included; an unterminated one runs to the end */
+			end := strings.IndexByte(input[i+1:], '\'')
+			if end < 0 {
+				tokens = append(tokens, input[i:])
+				return tokens
+			}
+			tokens = append(tokens, input[i:i+end+2])
+			i += end + 2
+		default:
+			start := i
+			for i < len(input) && strings.IndexByte(" \t<>=!,*()+-'", input[i]) < 0 {
+				i++
+			}
+			tokens = append(tokens, input[start:i])
+		}
 	}
-	return PREPARE_UNRECOGNISED_COMMAND
+	return tokens
 }
 
-func leafNodeInsert(cursor *Cursor, key uint32, value *Row) {
-	node := getPage(cursor.table.pager, cursor.pageNum)
-	numCells := *leafNodeNumcells(node)
-	if numCells >= uint32(LEAF_NODE_MAX_CELLS) {
-		leafNodeSplitAndInsert(cursor, key, value)
-		return
+// prepareWhere parses "where id <op> <key>", where op is one of > >= = <> !=.
+func prepareWhere(tokens []string, statement *Statement) PrepareResult {
+	if len(tokens) != 4 || tokens[0] != "where" || tokens[1] != "id" {
+		return PREPARE_SYNTAX_ERROR
 	}
 
-	if cursor.cellNum < numCells {
-		for i := numCells; i > cursor.cellNum; i-- {
-			copy(leafNodeCell(node, i), leafNodeCell(node, i-1))
-		}
+	switch tokens[2] {
+	case ">":
+		statement.where.operator = WHERE_GREATER
+	case ">=":
+		statement.where.operator = WHERE_GREATER_EQUAL
+	case "<>", "!=":
+		statement.where.operator = WHERE_NOT_EQUAL
+	case "=":
+		statement.where.operator = WHERE_EQUAL
+	default:
+		return PREPARE_SYNTAX_ERROR
 	}
-	*leafNodeNumcells(node)++
-	*leafNodeKey(node, cursor.cellNum) = key
-	serializeRow(value, leafNodeValue(node, cursor.cellNum))
-}
-
-func executeInsert(statement *Statement, table *Table) ExecuteResult {
-	node := getPage(table.pager, table.rootPageNum)
-	numCells := *leafNodeNumcells(node)
 
-	rowToInsert := &statement.rowToInsert
-	keyToInsert := rowToInsert.id
-	cursor := tableFind(table, keyToInsert)
+	key, err := strconv.ParseUint(tokens[3], 10, 32)
+	if err != nil {
+		return PREPARE_SYNTAX_ERROR
+	}
+	statement.where.key = uint32(key)
+	return PREPARE_SUCCESS
+}
 
-	if cursor.cellNum < numCells {
-		keyAtIndex := *leafNodeKey(node, cursor.cellNum)
-		if keyAtIndex == keyToInsert {
-			return EXECUTE_DUPLICATE_KEY
+// prepareProjection parses the column list after select: either "*" or
+// comma separated column names. It returns the tokens that follow it.
+func prepareProjection(tokens []string, statement *Statement) ([]string, PrepareResult) {
+	if tokens[0] == "*" {
+		if len(tokens) > 1 && tokens[1] == "," {
+			return nil, PREPARE_STAR_WITH_COLUMNS
 		}
+		return tokens[1:], PREPARE_SUCCESS
 	}
 
-	leafNodeInsert(cursor, rowToInsert.id, rowToInsert)
-	return EXECUTE_SUCCESS
-}
-
-func executeSelect(statement *Statement, table *Table) ExecuteResult {
-	cursor := tableStart(table)
-	var row Row
-	for !cursor.endOfTable {
-		deserializeRow(&row, cursorValue(cursor))
-		fmt.Printf("(%d %s %s)\n", row.id, row.username, row.email)
-		cursorAdvance(cursor)
+	for {
+		if tokens[0] == "*" {
+			return nil, PREPARE_STAR_WITH_COLUMNS
+		}
+		column, ok := lookupColumn(tokens[0])
+		if !ok {
+			return nil, PREPARE_SYNTAX_ERROR
+		}
+		statement.columns = append(statement.columns, column)
+		tokens = tokens[1:]
+		if len(tokens) == 0 || tokens[0] != "," {
+			return tokens, PREPARE_SUCCESS
+		}
+		tokens = tokens[1:]
+		if len(tokens) == 0 {
+			return nil, PREPARE_SYNTAX_ERROR
+		}
 	}
-	return EXECUTE_SUCCESS
 }
 
-func executeStatement(statement *Statement, table *Table) ExecuteResult {
-	switch statement.typ {
-	case STATEMENT_INSERT:
-		return executeInsert(statement, table)
-	case STATEMENT_SELECT:
-		return executeSelect(statement, table)
-	}
-	return EXECUTE_SUCCESS
+func isConstantToken(token string) bool {
+	return token == "-" || strings.HasPrefix(token, "'") || token[0] >= '0' && token[0] <= '9'
 }
 
-func main() {
-	if len(os.Args) < 2 {
-		fmt.Println("Must supply a database file name")
-		os.Exit(1)
+// prepareConstant parses the expression of a select without a table: a
+// quoted string, or integers joined by + and -.
+func prepareConstant(tokens []string, statement *Statement) PrepareResult {
+	statement.typ = STATEMENT_SELECT_CONSTANT
+	if len(tokens) == 1 && strings.HasPrefix(tokens[0], "'") {
+		if len(tokens[0]) < 2 || !strings.HasSuffix(tokens[0], "'") {
+			return PREPARE_SYNTAX_ERROR
+		}
+		statement.constant = tokens[0][1 : len(tokens[0])-1]
+		return PREPARE_SUCCESS
 	}
-	filename := os.Args[1]
-	table := dbOpen(filename)
-	inputBuffer := newInputBuffer()
+
+	var sum int64
+	sign := int64(1)
 	for {
-		printPrompt()
-		readInput(inputBuffer)
-		if strings.HasPrefix(inputBuffer.buffer, ".") {
-			switch doMetaCommand(inputBuffer, table) {
-			case META_COMMAND_SUCCESS:
-				continue
-			case META_UNRECOGNISED_COMMAND:
-				fmt.Printf("Unrecognised Command: %s\n", inputBuffer.buffer)
-				continue
+		if len(tokens) > 0 && tokens[0] == "-" {
+			sign = -sign
+			tokens = tokens[1:]
+		}
+		if len(tokens) == 0 {
+			return PREPARE_SYNTAX_ERROR
+		}
+		value, err := strconv.ParseInt(tokens[0], 10, 32)
+		if err != nil {
+			return PREPARE_SYNTAX_ERROR
+		}
+		sum += sign * value
+		tokens = tokens[1:]
+		if len(tokens) == 0 {
+			break
+		}
+		switch tokens[0] {
+		case "+":
+			sign = 1
+		case "-":
+			sign = -1
+		default:
+			return PREPARE_SYNTAX_ERROR
+		}
+		tokens = tokens[1:]
+	}
+	statement.constant = strconv.FormatInt(sum, 10)
+	return PREPARE_SUCCESS
+}
+
+// prepareLimit takes a trailing "limit <n>" off tokens, returning the
+// tokens before it.
+func prepareLimit(tokens []string, statement *Statement) ([]string, PrepareResult) {
+	if len(tokens) < 2 || tokens[len(tokens)-2] != "limit" {
+		return tokens, PREPARE_SUCCESS
+	}
+	limit, err := strconv.ParseUint(tokens[len(tokens)-1], 10, 32)
+	if err != nil {
+		return nil, PREPARE_SYNTAX_ERROR
+	}
+	statement.hasLimit = true
+	statement.limit = uint32(limit)
+	return tokens[:len(tokens)-2], PREPARE_SUCCESS
+}
+
+// prepareOrderBy takes a trailing "order by id [asc | desc]" off tokens.
+// Rows are stored in id order, so id is the only column that can be sorted
+// on without reading the whole table.
+func prepareOrderBy(tokens []string, statement *Statement) ([]string, PrepareResult) {
+	n := len(tokens)
+	if n >= 4 && tokens[n-4] == "order" && (tokens[n-1] == "asc" || tokens[n-1] == "desc") {
+		statement.descending = tokens[n-1] == "desc"
+		tokens = tokens[:n-1]
+		n--
+	}
+	if n < 3 || tokens[n-3] != "order" {
+		return tokens, PREPARE_SUCCESS
+	}
+	if tokens[n-2] != "by" || tokens[n-1] != "id" {
+		return nil, PREPARE_SYNTAX_ERROR
+	}
+	return tokens[:n-3], PREPARE_SUCCESS
+}
+
+// prepareRange parses the "<low> <high>" of "select 10 20", every row with
+// an id from low to high inclusive. Two bare numbers are not a valid
+// constant expression, so this takes nothing away from "select 10".
+func prepareRange(tokens []string, statement *Statement) bool {
+	low, lowErr := strconv.ParseUint(tokens[0], 10, 32)
+	high, highErr := strconv.ParseUint(tokens[1], 10, 32)
+	if lowErr != nil || highErr != nil {
+		return false
+	}
+	statement.where = WhereClause{operator: WHERE_BETWEEN, key: uint32(low), high: uint32(high)}
+	return true
+}
+
+// prepareSelect parses "select [* | column, ...] [where ...]
+// [order by id [asc | desc]] [limit n]". A bare select is the same as
+// select *.
+func prepareSelect(inputBuffer *InputBuffer, statement *Statement) PrepareResult {
+	tokens := tokenize(inputBuffer.buffer)
+	if tokens[0] != "select" {
+		return PREPARE_UNRECOGNISED_COMMAND
+	}
+	statement.typ = STATEMENT_SELECT
+	tokens = tokens[1:]
+
+	if len(tokens) == 2 && prepareRange(tokens, statement) {
+		return PREPARE_SUCCESS
+	}
+	if len(tokens) > 0 && isConstantToken(tokens[0]) {
+		return prepareConstant(tokens, statement)
+	}
+
+	tokens, result := prepareLimit(tokens, statement)
+	if result != PREPARE_SUCCESS {
+		return result
+	}
+	tokens, result = prepareOrderBy(tokens, statement)
+	if result != PREPARE_SUCCESS {
+		return result
+	}
+
+	if len(tokens) > 0 && tokens[0] != "where" {
+		tokens, result = prepareProjection(tokens, statement)
+		if result != PREPARE_SUCCESS {
+			return result
+		}
+	}
+
+	if len(tokens) == 0 {
+		return PREPARE_SUCCESS
+	}
+	return prepareWhere(tokens, statement)
+}
+
+func prepareErrorMessage(result PrepareResult, input string) string {
+	switch result {
+	case PREPARE_SYNTAX_ERROR:
+		return "Syntax error. couldn't parse statement"
+	case PREPARE_UNRECOGNISED_COMMAND:
+		return fmt.Sprintf("Unrecognised Command: %s", input)
+	case PREPARE_TOO_MANY_VALUES:
+		return fmt.Sprintf("Syntax error. too many values, expected: %s <id> <username> <email>", strings.Fields(strings.TrimPrefix(input, "explain "))[0])
+	case PREPARE_STRING_TOO_LONG:
+		return stringTooLongMessage(input)
+	case PREPARE_NEGATIVE_ID:
+		return "Syntax error. illegal id"
+	case PREPARE_NULL_ID:
+		return "Error: primary key cannot be NULL"
+	case PREPARE_STAR_WITH_COLUMNS:
+		return "Syntax error. cannot combine * with explicit columns"
+	}
+	return ""
+}
+
+// stringTooLongMessage names the first text column of an insert whose value
+// overflowed, with its length and the column's limit.
+func stringTooLongMessage(input string) string {
+	parts := strings.Fields(strings.TrimPrefix(input, "explain "))
+	columns := []Column{COLUMN_USERNAME, COLUMN_EMAIL}
+	limits := []int{COLUMN_USERNAME_SIZE, COLUMN_EMAIL_SIZE}
+	for i, column := range columns {
+		if 2+i < len(parts) && len(parts[2+i]) > limits[i] {
+			return fmt.Sprintf("Error: value for column '%s' is %d bytes, exceeds %d", columnNames[column], len(parts[2+i]), limits[i])
+		}
+	}
+	return "Error: value too long for column"
+}
+
+// checkScript parses every statement in the script at filename without
+// executing any of them, printing each failure with its line number. Meta
+// commands are not checked, and lines longer than maxStatementLength are
+// reported the way -f would refuse them. It reports whether every
+// statement parsed.
+func checkScript(filename string, maxStatementLength int) (bool, error) {
+	reader, err := openScript(filename)
+	if err != nil {
+		return false, err
+	}
+	defer reader.Close()
+
+	ok := true
+	lineNum := 0
+	tooLarge := func() {
+		fmt.Printf("%s:%d: statement too large, the limit is %d bytes\n", filename, lineNum, maxStatementLength)
+		ok = false
+	}
+	scanner := bufio.NewScanner(reader)
+	/* Room for the longest statement allowed plus its line ending */
+	scanner.Buffer(nil, maxStatementLength+2)
+	for scanner.Scan() {
+		lineNum++
+		if len(scanner.Bytes()) > maxStatementLength {
+			tooLarge()
+			continue
+		}
+		input := normalizeInput(scanner.Text())
+		if len(input) == 0 || strings.HasPrefix(input, ".") {
+			continue
+		}
+		inputBuffer := &InputBuffer{buffer: input}
+		if result := prepareStatement(inputBuffer, &Statement{}); result != PREPARE_SUCCESS {
+			fmt.Printf("%s:%d: %s\n", filename, lineNum, prepareErrorMessage(result, input))
+			ok = false
+		}
+	}
+	/* The scanner cannot resume after an over-long line, so checking ends there */
+	if scanner.Err() == bufio.ErrTooLong {
+		lineNum++
+		tooLarge()
+		return false, nil
+	}
+	return ok, scanner.Err()
+}
+
+func prepareStatement(inputBuffer *InputBuffer, statement *Statement) PrepareResult {
+	if strings.HasPrefix(inputBuffer.buffer, "explain ") {
+		return prepareExplain(inputBuffer, statement)
+	}
+	if strings.HasPrefix(inputBuffer.buffer, "insert") {
+		return prepareInsert(inputBuffer, statement)
+	}
+	if strings.HasPrefix(inputBuffer.buffer, "select") {
+		return prepareSelect(inputBuffer, statement)
+	}
+	if strings.HasPrefix(inputBuffer.buffer, "delete") {
+		return prepareDelete(inputBuffer, statement)
+	}
+	if strings.HasPrefix(inputBuffer.buffer, "update") {
+		return prepareUpdate(inputBuffer, statement)
+	}
+	return PREPARE_UNRECOGNISED_COMMAND
+}
+
+// prepareDelete parses "delete <id>".
+func prepareDelete(inputBuffer *InputBuffer, statement *Statement) PrepareResult {
+	parts := strings.Fields(inputBuffer.buffer)
+	if parts[0] != "delete" {
+		return PREPARE_UNRECOGNISED_COMMAND
+	}
+	if len(parts) != 2 {
+		return PREPARE_SYNTAX_ERROR
+	}
+	id, err := strconv.ParseUint(parts[1], 10, 32)
+	if err != nil {
+		return PREPARE_NEGATIVE_ID
+	}
+	statement.typ = STATEMENT_DELETE
+	statement.key = uint32(id)
+	return PREPARE_SUCCESS
+}
+
+// prepareUpdate parses "update <id> <username> <email>", which takes the
+// same values as an insert.
+func prepareUpdate(inputBuffer *InputBuffer, statement *Statement) PrepareResult {
+	if result := prepareInsert(inputBuffer, statement); result != PREPARE_SUCCESS {
+		return result
+	}
+	statement.typ = STATEMENT_UPDATE
+	return PREPARE_SUCCESS
+}
+
+// prepareExplain parses "explain insert ...", which reports what the insert
+// would do to the tree without running it. Only inserts can be explained.
+func prepareExplain(inputBuffer *InputBuffer, statement *Statement) PrepareResult {
+	inner := &InputBuffer{buffer: strings.TrimSpace(strings.TrimPrefix(inputBuffer.buffer, "explain "))}
+	if !strings.HasPrefix(inner.buffer, "insert") {
+		return PREPARE_SYNTAX_ERROR
+	}
+	if result := prepareInsert(inner, statement); result != PREPARE_SUCCESS {
+		return result
+	}
+	statement.typ = STATEMENT_EXPLAIN_INSERT
+	return PREPARE_SUCCESS
+}
+
+// insertSplitPages returns the pages an insert into the leaf at pageNum
+// would split, starting with the leaf and climbing through each full parent.
+func insertSplitPages(table *Table, pageNum uint32) ([]uint32, error) {
+	node, err := getPage(table.pager, pageNum)
+	if err != nil {
+		return nil, err
+	}
+	if leafNodeNumcells(node) < table.leafNodeMaxCells {
+		return nil, nil
+	}
+	pages := []uint32{pageNum}
+	for !isNodeRoot(node) {
+		parentPageNum := nodeParent(node)
+		node, err = getPage(table.pager, parentPageNum)
+		if err != nil {
+			return nil, err
+		}
+		if internalNodeNumKeys(node) < table.internalNodeMaxCells {
+			break
+		}
+		pages = append(pages, parentPageNum)
+	}
+	return pages, nil
+}
+
+// insertPagesNeeded returns how many new pages an insert into the leaf at
+// pageNum would allocate: one for each node that splits, plus one more if
+// the root splits, since its contents move into a new left child.
+func insertPagesNeeded(table *Table, pageNum uint32) (uint32, error) {
+	pages, err := insertSplitPages(table, pageNum)
+	if err != nil || len(pages) == 0 {
+		return 0, err
+	}
+	top, err := getPage(table.pager, pages[len(pages)-1])
+	if err != nil {
+		return 0, err
+	}
+	needed := uint32(len(pages))
+	if isNodeRoot(top) {
+		needed++
+	}
+	return needed, nil
+}
+
+// tableHasRoomFor reports whether an insert into the leaf at pageNum fits in
+// the pager. Checking first means a full table refuses the insert before
+// any split has moved a cell.
+func tableHasRoomFor(table *Table, pageNum uint32) (bool, error) {
+	needed, err := insertPagesNeeded(table, pageNum)
+	if err != nil {
+		return false, err
+	}
+	return needed <= pagesAvailable(table.pager), nil
+}
+
+func leafNodeInsert(cursor *Cursor, key uint32, value *Row) error {
+	node, err := getPage(cursor.table.pager, cursor.pageNum)
+	if err != nil {
+		return err
+	}
+	numCells := leafNodeNumcells(node)
+	if numCells >= cursor.table.leafNodeMaxCells {
+		return leafNodeSplitAndInsert(cursor, key, value)
+	}
+
+	if cursor.cellNum < numCells {
+		for i := numCells; i > cursor.cellNum; i-- {
+			copy(leafNodeCell(node, i), leafNodeCell(node, i-1))
+		}
+	}
+	setLeafNodeNumcells(node, leafNodeNumcells(node)+1)
+	setLeafNodeKey(node, cursor.cellNum, key)
+	serializeRow(value, leafNodeValue(node, cursor.cellNum))
+	return nil
+}
+
+func executeInsert(statement *Statement, table *Table) (ExecuteResult, error) {
+	rowToInsert := &statement.rowToInsert
+	keyToInsert := rowToInsert.id
+	cursor, err := tableFind(table, keyToInsert)
+	if err != nil {
+		return EXECUTE_SUCCESS, err
+	}
+
+	node, err := getPage(table.pager, cursor.pageNum)
+	if err != nil {
+		return EXECUTE_SUCCESS, err
+	}
+	numCells := leafNodeNumcells(node)
+	if cursor.cellNum < numCells {
+		keyAtIndex := leafNodeKey(node, cursor.cellNum)
+		if keyAtIndex == keyToInsert {
+			switch table.duplicatePolicy {
+			case DUPLICATE_IGNORE:
+				return EXECUTE_SUCCESS, nil
+			case DUPLICATE_REPLACE:
+				serializeRow(rowToInsert, leafNodeValue(node, cursor.cellNum))
+				return EXECUTE_SUCCESS, nil
 			}
+			return EXECUTE_DUPLICATE_KEY, nil
 		}
+	}
 
-		statement := &Statement{}
-		switch prepareStatement(inputBuffer, statement) {
-		case PREPARE_SUCCESS:
+	hasRoom, err := tableHasRoomFor(table, cursor.pageNum)
+	if err != nil {
+		return EXECUTE_SUCCESS, err
+	}
+	if !hasRoom {
+		return EXECUTE_TABLE_FULL, nil
+	}
+	if err := leafNodeInsert(cursor, rowToInsert.id, rowToInsert); err != nil {
+		return EXECUTE_SUCCESS, err
+	}
+	return EXECUTE_SUCCESS, nil
+}
+
+// executeAppend is executeInsert for .fastload: the row goes straight to the
+// end of the rightmost leaf, so its key must be above every key stored.
+func executeAppend(statement *Statement, table *Table) (ExecuteResult, error) {
+	rowToInsert := &statement.rowToInsert
+	cursor, err := tableEnd(table)
+	if err != nil {
+		return EXECUTE_SUCCESS, err
+	}
+	if cursor.cellNum > 0 {
+		node, err := getPage(table.pager, cursor.pageNum)
+		if err != nil {
+			return EXECUTE_SUCCESS, err
+		}
+		lastKey := leafNodeKey(node, cursor.cellNum-1)
+		if rowToInsert.id <= lastKey {
+			return EXECUTE_SUCCESS, fmt.Errorf("fastload needs increasing ids: %d is not above %d", rowToInsert.id, lastKey)
+		}
+	}
+	hasRoom, err := tableHasRoomFor(table, cursor.pageNum)
+	if err != nil {
+		return EXECUTE_SUCCESS, err
+	}
+	if !hasRoom {
+		return EXECUTE_TABLE_FULL, nil
+	}
+	if err := leafNodeInsert(cursor, rowToInsert.id, rowToInsert); err != nil {
+		return EXECUTE_SUCCESS, err
+	}
+	return EXECUTE_SUCCESS, nil
+}
+
+// leafNodeDelete removes the cell under the cursor, shifting the cells after
+// it down. A leaf other than the root left with fewer than
+// leafNodeMinCells cells is merged with or borrows from a sibling, so only
+// the root can ever be empty.
+func leafNodeDelete(cursor *Cursor) error {
+	table := cursor.table
+	node, err := getPage(table.pager, cursor.pageNum)
+	if err != nil {
+		return err
+	}
+	numCells := leafNodeNumcells(node)
+	for i := cursor.cellNum; i+1 < numCells; i++ {
+		copy(leafNodeCell(node, i), leafNodeCell(node, i+1))
+	}
+	setLeafNodeNumcells(node, numCells-1)
+	if table.zeroFreedCells {
+		zeroLeafCellsFrom(node, numCells-1)
+	}
+	if isNodeRoot(node) || numCells-1 >= leafNodeMinCells(table) {
+		return nil
+	}
+	return leafNodeRebalance(table, cursor.pageNum)
+}
+
+func executeDelete(statement *Statement, table *Table) (ExecuteResult, error) {
+	cursor, err := tableFind(table, statement.key)
+	if err != nil {
+		return EXECUTE_SUCCESS, err
+	}
+	node, err := getPage(table.pager, cursor.pageNum)
+	if err != nil {
+		return EXECUTE_SUCCESS, err
+	}
+	if cursor.cellNum >= leafNodeNumcells(node) || leafNodeKey(node, cursor.cellNum) != statement.key {
+		return EXECUTE_KEY_NOT_FOUND, nil
+	}
+	if err := leafNodeDelete(cursor); err != nil {
+		return EXECUTE_SUCCESS, err
+	}
+	return EXECUTE_SUCCESS, nil
+}
+
+// executeUpdate rewrites the row with the statement's id in place. The key
+// does not change, so the tree is never restructured.
+func executeUpdate(statement *Statement, table *Table) (ExecuteResult, error) {
+	row := &statement.rowToInsert
+	cursor, err := tableFind(table, row.id)
+	if err != nil {
+		return EXECUTE_SUCCESS, err
+	}
+	node, err := getPage(table.pager, cursor.pageNum)
+	if err != nil {
+		return EXECUTE_SUCCESS, err
+	}
+	if cursor.cellNum >= leafNodeNumcells(node) || leafNodeKey(node, cursor.cellNum) != row.id {
+		return EXECUTE_KEY_NOT_FOUND, nil
+	}
+	serializeRow(row, leafNodeValue(node, cursor.cellNum))
+	return EXECUTE_SUCCESS, nil
+}
+
+func columnValue(row *Row, column Column) string {
+	switch column {
+	case COLUMN_USERNAME:
+		return row.username
+	case COLUMN_EMAIL:
+		return row.email
+	}
+	return strconv.FormatUint(uint64(row.id), 10)
+}
+
+// printRow writes the projected columns of row in the session's output
+// mode. OUTPUT_MODE_INSERT emits an insert statement that re-creates the
+// row when fed back in, so it always carries every column.
+func printRow(row *Row, columns []Column, session *Session) {
+	switch session.outputMode {
+	case OUTPUT_MODE_INSERT:
+		fmt.Printf("insert %d %s %s\n", row.id, row.username, row.email)
+	default:
+		if columns == nil {
+			columns = []Column{COLUMN_ID, COLUMN_USERNAME, COLUMN_EMAIL}
+		}
+		values := make([]string, len(columns))
+		for i, column := range columns {
+			values[i] = displayText(columnValue(row, column), session.nulDisplay)
+		}
+		fmt.Printf("(%s)\n", strings.Join(values, " "))
+	}
+}
+
+func displayText(value string, mode NulDisplay) string {
+	switch mode {
+	case NUL_DISPLAY_RAW:
+		return value
+	case NUL_DISPLAY_ESCAPED:
+		var builder strings.Builder
+		for i := 0; i < len(value); i++ {
+			if value[i] < 0x20 || value[i] == 0x7f {
+				fmt.Fprintf(&builder, "\\x%02x", value[i])
+			} else {
+				builder.WriteByte(value[i])
+			}
+		}
+		return builder.String()
+	}
+	if end := strings.IndexByte(value, 0); end >= 0 {
+		return value[:end]
+	}
+	return value
+}
+
+// selectStart positions a cursor at the first row the statement can match.
+// Lower bounds on id seek straight to the matching leaf instead of
+// scanning from the start of the table.
+func selectStart(statement *Statement, table *Table) (*Cursor, error) {
+	switch statement.where.operator {
+	case WHERE_GREATER, WHERE_GREATER_EQUAL, WHERE_EQUAL, WHERE_BETWEEN:
+		cursor, err := tableSeek(table, statement.where.key)
+		if err != nil {
+			return nil, err
+		}
+		if statement.where.operator != WHERE_GREATER || cursor.endOfTable {
+			return cursor, nil
+		}
+		key, err := cursorKey(cursor)
+		if err != nil {
+			return nil, err
+		}
+		if key == statement.where.key {
+			if err := cursorAdvance(cursor); err != nil {
+				return nil, err
+			}
+		}
+		return cursor, nil
+	}
+	return tableStart(table)
+}
+
+// whereAbove reports whether key meets the lower bound of where. A forward
+// scan starts at the bound instead; a backward one stops at the first key
+// below it.
+func whereAbove(where WhereClause, key uint32) bool {
+	switch where.operator {
+	case WHERE_GREATER:
+		return key > where.key
+	case WHERE_GREATER_EQUAL, WHERE_EQUAL, WHERE_BETWEEN:
+		return key >= where.key
+	}
+	return true
+}
+
+// whereBelow reports whether key is within the upper bound of where; a
+// forward scan stops at the first key past it.
+func whereBelow(where WhereClause, key uint32) bool {
+	switch where.operator {
+	case WHERE_EQUAL:
+		return key <= where.key
+	case WHERE_BETWEEN:
+		return key <= where.high
+	}
+	return true
+}
+
+// whereMatches reports whether a row with the given id passes where. Lower
+// bounds are already met by where the scan starts, so only the predicates
+// that skip rows mid-scan are tested here.
+func whereMatches(where WhereClause, key uint32) bool {
+	switch where.operator {
+	case WHERE_NOT_EQUAL:
+		return key != where.key
+	}
+	return true
+}
+
+// InsertPlan describes what an insert would do to the tree, as worked out
+// by explainInsert without changing anything.
+type InsertPlan struct {
+	key         uint32
+	leafPageNum uint32
+	duplicate   bool
+	// Pages that would split, leaf first; empty if the leaf has room.
+	splitPages []uint32
+	newPages   uint32
+	tableFull  bool
+}
+
+func explainInsert(statement *Statement, table *Table) (*InsertPlan, error) {
+	key := statement.rowToInsert.id
+	cursor, err := tableFind(table, key)
+	if err != nil {
+		return nil, err
+	}
+	plan := &InsertPlan{key: key, leafPageNum: cursor.pageNum}
+	node, err := getPage(table.pager, cursor.pageNum)
+	if err != nil {
+		return nil, err
+	}
+	if cursor.cellNum < leafNodeNumcells(node) && leafNodeKey(node, cursor.cellNum) == key {
+		plan.duplicate = true
+		return plan, nil
+	}
+	plan.splitPages, err = insertSplitPages(table, cursor.pageNum)
+	if err != nil {
+		return nil, err
+	}
+	plan.newPages, err = insertPagesNeeded(table, cursor.pageNum)
+	if err != nil {
+		return nil, err
+	}
+	plan.tableFull = plan.newPages > pagesAvailable(table.pager)
+	return plan, nil
+}
+
+func printInsertPlan(plan *InsertPlan) {
+	fmt.Printf("insert %d: leaf page %d\n", plan.key, plan.leafPageNum)
+	switch {
+	case plan.duplicate:
+		fmt.Println("key already present, nothing would be inserted")
+	case len(plan.splitPages) == 0:
+		fmt.Println("no split")
+	default:
+		pages := make([]string, len(plan.splitPages))
+		for i, pageNum := range plan.splitPages {
+			pages[i] = strconv.Itoa(int(pageNum))
+		}
+		fmt.Printf("splits pages: %s\n", strings.Join(pages, ", "))
+		fmt.Printf("new pages: %d\n", plan.newPages)
+	}
+	if plan.tableFull {
+		fmt.Println("table full, the insert would be refused")
+	}
+}
+
+// executeSelect prints the matching rows. Rows always come out in strictly
+// ascending id order: the scan follows the leaf chain left to right, and
+// splits keep every key in the left leaf below every key in the right one.
+func executeSelect(statement *Statement, table *Table, session *Session) (ExecuteResult, error) {
+	/* A point lookup returns at most one row, so its order does not matter */
+	if statement.descending && statement.where.operator != WHERE_EQUAL {
+		return executeSelectDescending(statement, table, session)
+	}
+	cursor, err := selectStart(statement, table)
+	if err != nil {
+		return EXECUTE_SUCCESS, err
+	}
+	var row Row
+	printed := 0
+	for !cursor.endOfTable {
+		/* The scan stops at the limit rather than reading rows it would drop */
+		if statement.hasLimit && printed == int(statement.limit) {
 			break
-		case PREPARE_SYNTAX_ERROR:
-			fmt.Printf("Syntax error. couldn't parse statement\n")
+		}
+		key, err := cursorKey(cursor)
+		if err != nil {
+			return EXECUTE_SUCCESS, err
+		}
+		if !whereBelow(statement.where, key) {
+			break
+		}
+		if !whereMatches(statement.where, key) {
+			if err := cursorAdvance(cursor); err != nil {
+				return EXECUTE_SUCCESS, err
+			}
 			continue
-		case PREPARE_UNRECOGNISED_COMMAND:
+		}
+		if session.rowLimit > 0 && printed == session.rowLimit {
+			fmt.Println("... (truncated)")
+			break
+		}
+		value, err := cursorValue(cursor)
+		if err != nil {
+			return EXECUTE_SUCCESS, err
+		}
+		deserializeRow(&row, value)
+		printRow(&row, statement.columns, session)
+		printed++
+		if err := cursorAdvance(cursor); err != nil {
+			return EXECUTE_SUCCESS, err
+		}
+	}
+	if statement.where.operator == WHERE_EQUAL && printed == 0 {
+		fmt.Println("(no rows)")
+	}
+	return EXECUTE_SUCCESS, nil
+}
+
+// executeSelectDescending walks the tree backwards from the end, so a
+// limit stops the scan after the pages holding the highest ids.
+func executeSelectDescending(statement *Statement, table *Table, session *Session) (ExecuteResult, error) {
+	var row Row
+	printed := 0
+	limitReached := func() bool {
+		return statement.hasLimit && printed == int(statement.limit)
+	}
+	err := tableScanReverse(table, func(pageNum uint32, node []byte, cellNum uint32) bool {
+		key := leafNodeKey(node, cellNum)
+		if !whereAbove(statement.where, key) || limitReached() {
+			return false
+		}
+		if !whereBelow(statement.where, key) || !whereMatches(statement.where, key) {
+			return true
+		}
+		if session.rowLimit > 0 && printed == session.rowLimit {
+			fmt.Println("... (truncated)")
+			return false
+		}
+		deserializeRow(&row, leafNodeValue(node, cellNum))
+		printRow(&row, statement.columns, session)
+		printed++
+		return !limitReached()
+	})
+	return EXECUTE_SUCCESS, err
+}
+
+func executeStatement(statement *Statement, table *Table, session *Session) (ExecuteResult, error) {
+	switch statement.typ {
+	case STATEMENT_INSERT:
+		if session.fastload {
+			return executeAppend(statement, table)
+		}
+		return executeInsert(statement, table)
+	case STATEMENT_SELECT:
+		return executeSelect(statement, table, session)
+	case STATEMENT_SELECT_CONSTANT:
+		fmt.Printf("(%s)\n", statement.constant)
+	case STATEMENT_EXPLAIN_INSERT:
+		plan, err := explainInsert(statement, table)
+		if err != nil {
+			return EXECUTE_SUCCESS, err
+		}
+		printInsertPlan(plan)
+	case STATEMENT_DELETE:
+		return executeDelete(statement, table)
+	case STATEMENT_UPDATE:
+		return executeUpdate(statement, table)
+	}
+	return EXECUTE_SUCCESS, nil
+}
+
+// processInput runs one line of input, either a meta command or a
+// statement, and prints its outcome.
+func processInput(inputBuffer *InputBuffer, session *Session) {
+	if len(inputBuffer.buffer) == 0 {
+		return
+	}
+	length := max(inputBuffer.bufferLength, len(inputBuffer.buffer))
+	if length > session.maxStatementLength {
+		fmt.Printf("Error: statement too large (%d bytes, the limit is %d)\n", length, session.maxStatementLength)
+		return
+	}
+	if strings.HasPrefix(inputBuffer.buffer, ".") {
+		result, err := doMetaCommand(inputBuffer, session)
+		if err != nil {
+			fmt.Printf("Error: %s\n", err)
+			return
+		}
+		if result == META_UNRECOGNISED_COMMAND {
 			fmt.Printf("Unrecognised Command: %s\n", inputBuffer.buffer)
-			continue
-		case PREPARE_SYNTAX_TOO_LONG:
-			fmt.Printf("Syntax error. syntax too long\n")
-			continue
-		case PREPARE_NEGATIVE_ID:
-			fmt.Printf("Syntax error. illegal id\n")
-			continue
 		}
+		return
+	}
 
-		switch executeStatement(statement, table) {
-		case EXECUTE_SUCCESS:
-			fmt.Println("executed.")
-		case EXECUTE_TABLE_FULL:
-			fmt.Println("Error:Table full")
-		case EXECUTE_DUPLICATE_KEY:
-			fmt.Println("Error: Duplicate key")
+	statement := &Statement{}
+	if result := prepareStatement(inputBuffer, statement); result != PREPARE_SUCCESS {
+		fmt.Println(prepareErrorMessage(result, inputBuffer.buffer))
+		return
+	}
+
+	result, err := executeStatement(statement, session.table, session)
+	if err != nil {
+		fmt.Printf("Error: %s\n", err)
+		return
+	}
+	switch result {
+	case EXECUTE_SUCCESS:
+		fmt.Println("executed.")
+	case EXECUTE_TABLE_FULL:
+		fmt.Println("Error:Table full")
+	case EXECUTE_DUPLICATE_KEY:
+		fmt.Println("Error: Duplicate key")
+	case EXECUTE_KEY_NOT_FOUND:
+		fmt.Println("Error: Key not found")
+	}
+}
+
+func main() {
+	existing := flag.Bool("existing", false, "fail if the database file does not already exist")
+	onDuplicate := flag.String("on-duplicate", "error", "what inserting an existing id does: error, ignore or replace")
+	check := flag.String("check", "", "parse every statement in this script and report errors, without opening a database")
+	script := flag.String("f", "", "run the statements in this script instead of reading from stdin")
+	zeroFill := flag.Bool("zero-fill", false, "zero the space rows are moved out of by splits, deletes and merges")
+	maxStatement := flag.Int("max-statement-bytes", DEFAULT_MAX_STATEMENT_LENGTH, "reject input lines longer than this many bytes")
+	prompt := flag.String("prompt", defaultPrompt(), "REPL prompt; defaults to $TINYSQL_PROMPT if set")
+	flag.Parse()
+
+	if *maxStatement <= 0 {
+		fmt.Printf("Error: -max-statement-bytes must be positive, got %d\n", *maxStatement)
+		os.Exit(1)
+	}
+	if *check != "" {
+		ok, err := checkScript(*check, *maxStatement)
+		if err != nil {
+			fmt.Printf("Error: %s\n", err)
+			os.Exit(1)
+		}
+		if !ok {
+			os.Exit(1)
+		}
+		os.Exit(0)
+	}
+
+	if flag.NArg() < 1 {
+		fmt.Println("Must supply a database file name")
+		os.Exit(1)
+	}
+	filename := flag.Arg(0)
+	duplicatePolicy, err := parseDuplicatePolicy(*onDuplicate)
+	if err != nil {
+		fmt.Printf("Error: %s\n", err)
+		os.Exit(1)
+	}
+
+	open := dbOpen
+	if *existing {
+		open = dbOpenExisting
+	}
+	table, err := open(filename)
+	if err != nil {
+		fmt.Printf("Error: %s\n", err)
+		os.Exit(1)
+	}
+	table.duplicatePolicy = duplicatePolicy
+	table.zeroFreedCells = *zeroFill
+	session := newSession()
+	session.table = table
+	session.existingOnly = *existing
+	session.prompt = *prompt
+	session.maxStatementLength = *maxStatement
+	closeAndExit := func(code int) {
+		if err := dbClose(session.table); err != nil {
+			fmt.Printf("Error: %s\n", err)
+			code = 1
+		}
+		os.Exit(code)
+	}
+	if *script != "" {
+		if err := runScript(*script, session); err != nil {
+			fmt.Printf("Error: %s\n", err)
+			closeAndExit(1)
+		}
+		closeAndExit(0)
+	}
+
+	if isTerminal(os.Stdin) {
+		printBanner(filename)
+	}
+	inputBuffer := newInputBuffer()
+	for {
+		printPrompt(session)
+		if err := readInput(inputBuffer, session.maxStatementLength); err != nil {
+			if err == io.EOF {
+				fmt.Println()
+				closeAndExit(0)
+			}
+			fmt.Println("Error reading input")
+			os.Exit(1)
 		}
+		processInput(inputBuffer, session)
 	}
 }
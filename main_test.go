@@ -0,0 +1,2435 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"math/rand"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+)
+
+var update = flag.Bool("update", false, "rewrite the golden files in testdata")
+
+// TestMain runs main instead of the tests when TINYSQL_RUN_MAIN is set,
+// which is how runMain drives the program in a child process.
+func TestMain(m *testing.M) {
+	if os.Getenv("TINYSQL_RUN_MAIN") == "1" {
+		main()
+		return
+	}
+	os.Exit(m.Run())
+}
+
+// runMain runs the program with args, feeding it stdin, and returns what
+// it printed and its exit code.
+func runMain(t *testing.T, stdin string, args ...string) (string, int) {
+	t.Helper()
+	cmd := exec.Command(os.Args[0], args...)
+	for _, env := range os.Environ() {
+		if !strings.HasPrefix(env, "TINYSQL_PROMPT=") {
+			cmd.Env = append(cmd.Env, env)
+		}
+	}
+	cmd.Env = append(cmd.Env, "TINYSQL_RUN_MAIN=1")
+	cmd.Stdin = strings.NewReader(stdin)
+	out, err := cmd.CombinedOutput()
+	var exitErr *exec.ExitError
+	if err != nil && !errors.As(err, &exitErr) {
+		t.Fatal(err)
+	}
+	return string(out), cmd.ProcessState.ExitCode()
+}
+
+// openTestTable opens a fresh database in a temporary directory and closes
+// it when the test ends.
+func openTestTable(t *testing.T) *Table {
+	t.Helper()
+	table, err := dbOpen(filepath.Join(t.TempDir(), "test.db"))
+	if err != nil {
+		t.Fatalf("dbOpen: %v", err)
+	}
+	t.Cleanup(func() {
+		if err := dbClose(table); err != nil {
+			t.Error(err)
+		}
+	})
+	return table
+}
+
+func insertRow(t *testing.T, table *Table, id uint32) ExecuteResult {
+	t.Helper()
+	statement := &Statement{
+		typ: STATEMENT_INSERT,
+		rowToInsert: Row{
+			id:       id,
+			username: fmt.Sprintf("user%d", id),
+			email:    fmt.Sprintf("person%d@example.com", id),
+		},
+	}
+	result, err := executeInsert(statement, table)
+	if err != nil {
+		t.Fatalf("insert %d: %v", id, err)
+	}
+	return result
+}
+
+func insertRows(t *testing.T, table *Table, ids ...uint32) {
+	t.Helper()
+	for _, id := range ids {
+		if result := insertRow(t, table, id); result != EXECUTE_SUCCESS {
+			t.Fatalf("insert %d: result %d", id, result)
+		}
+	}
+}
+
+// captureOutput returns what fn prints to stdout.
+func captureOutput(t *testing.T, fn func()) string {
+	t.Helper()
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	stdout := os.Stdout
+	os.Stdout = w
+	done := make(chan []byte)
+	go func() {
+		out, _ := io.ReadAll(r)
+		done <- out
+	}()
+	defer func() {
+		os.Stdout = stdout
+	}()
+	fn()
+	w.Close()
+	out := <-done
+	r.Close()
+	return string(out)
+}
+
+// runStatement prepares and executes one statement against table the way
+// the REPL does, returning what it prints.
+func runStatement(t *testing.T, table *Table, input string) string {
+	t.Helper()
+	session := newSession()
+	session.table = table
+	return runInput(t, session, input)
+}
+
+// runInput feeds one line to session the way the REPL does, returning what
+// it prints.
+func runInput(t *testing.T, session *Session, input string) string {
+	t.Helper()
+	return captureOutput(t, func() {
+		processInput(&InputBuffer{buffer: input}, session)
+	})
+}
+
+func deleteRow(t *testing.T, table *Table, id uint32) ExecuteResult {
+	t.Helper()
+	result, err := executeDelete(&Statement{typ: STATEMENT_DELETE, key: id}, table)
+	if err != nil {
+		t.Fatalf("delete %d: %v", id, err)
+	}
+	return result
+}
+
+// checkKeys fails unless the table holds exactly the keys in want.
+func checkKeys(t *testing.T, table *Table, want map[uint32]bool) {
+	t.Helper()
+	keys, err := tableKeys(table)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(keys) != len(want) {
+		t.Fatalf("table holds %d keys, want %d", len(keys), len(want))
+	}
+	for _, key := range keys {
+		if !want[key] {
+			t.Fatalf("table holds key %d, which should be gone", key)
+		}
+	}
+}
+
+// checkMinFill fails if a node below the root has fewer cells or keys than
+// a delete is allowed to leave, or if the root is an internal node with a
+// single child.
+func checkMinFill(t *testing.T, table *Table, pageNum uint32) {
+	t.Helper()
+	node := mustGetPage(t, table.pager, pageNum)
+	if getNodeType(node) == NODE_LEAF {
+		if !isNodeRoot(node) && leafNodeNumcells(node) < leafNodeMinCells(table) {
+			t.Fatalf("leaf page %d has %d cells, below the minimum %d", pageNum, leafNodeNumcells(node), leafNodeMinCells(table))
+		}
+		return
+	}
+	numKeys := internalNodeNumKeys(node)
+	if isNodeRoot(node) && numKeys == 0 {
+		t.Fatalf("root page %d is an internal node with one child", pageNum)
+	}
+	if !isNodeRoot(node) && numKeys < internalNodeMinKeys(table) {
+		t.Fatalf("internal page %d has %d keys, below the minimum %d", pageNum, numKeys, internalNodeMinKeys(table))
+	}
+	for i := uint32(0); i <= numKeys; i++ {
+		child, err := internalNodeChild(node, i)
+		if err != nil {
+			t.Fatal(err)
+		}
+		checkMinFill(t, table, child)
+	}
+}
+
+func treeHeight(t *testing.T, table *Table) uint32 {
+	t.Helper()
+	stats, err := treeStats(table)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return stats.height
+}
+
+func checkTreeOK(t *testing.T, table *Table) {
+	t.Helper()
+	if err := checkTree(table); err != nil {
+		t.Fatalf("checkTree: %v", err)
+	}
+}
+
+// mustGetPage is getPage for tests, failing the test on an error.
+func mustGetPage(t *testing.T, pager *Pager, pageNum uint32) []byte {
+	t.Helper()
+	page, err := getPage(pager, pageNum)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return page
+}
+
+func snapshotPages(t *testing.T, pager *Pager) [][]byte {
+	t.Helper()
+	pages := make([][]byte, pager.numPages)
+	for i := range pages {
+		pages[i] = bytes.Clone(mustGetPage(t, pager, uint32(i)))
+	}
+	return pages
+}
+
+func TestCorruptInternalNodeReturnsError(t *testing.T) {
+	table := openTestTable(t)
+	table.leafNodeMaxCells = 3
+	insertRows(t, table, 1, 2, 3, 4)
+	root := mustGetPage(t, table.pager, table.rootPageNum)
+	if getNodeType(root) != NODE_INTERNAL || internalNodeNumKeys(root) != 1 {
+		t.Fatal("four rows at fan-out 3 did not give a root with two children")
+	}
+
+	if _, err := internalNodeChild(root, 2); err == nil {
+		t.Error("internalNodeChild past the right child returned no error")
+	}
+
+	leftChild, err := internalNodeChild(root, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := setInternalNodeChild(root, 0, INVALID_PAGE_NUM); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := internalNodeChild(root, 0); err == nil {
+		t.Error("internalNodeChild of an invalid child pointer returned no error")
+	}
+	if _, err := tableFind(table, 1); err == nil {
+		t.Error("tableFind through an invalid child pointer returned no error")
+	}
+	if err := setInternalNodeChild(root, 0, leftChild); err != nil {
+		t.Fatal(err)
+	}
+
+	rightChild := internalNodeRightChild(root)
+	setInternalNodeRightChild(root, INVALID_PAGE_NUM)
+	if _, err := tableFind(table, 4); err == nil {
+		t.Error("tableFind through an invalid right child returned no error")
+	}
+	setInternalNodeRightChild(root, rightChild)
+	checkTreeOK(t, table)
+}
+
+func TestBlankLinesAndSemicolonsAreNoOps(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "test.db")
+	out, code := runMain(t, "\n;\n   ;;  \n.exit\n", filename)
+	if want := strings.Repeat(DEFAULT_PROMPT, 4); out != want || code != 0 {
+		t.Fatalf("output %q, exit code %d; want %q, 0", out, code, want)
+	}
+}
+
+func TestEOFClosesDatabase(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "test.db")
+	out, code := runMain(t, "insert 1 a a@example.com\ninsert 2 b b@example.com", filename)
+	want := DEFAULT_PROMPT + "executed.\n" + DEFAULT_PROMPT + "executed.\n" + DEFAULT_PROMPT + "\n"
+	if out != want || code != 0 {
+		t.Fatalf("output %q, exit code %d; want %q, 0", out, code, want)
+	}
+	if keys := fileKeys(t, filename); !slices.Equal(keys, []uint32{1, 2}) {
+		t.Fatalf("after EOF the file holds %v, want [1 2]", keys)
+	}
+}
+
+// Creating nothing matters as much as the error: a typo must not leave an
+// empty database behind.
+func TestOpenExistingMissingFile(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "missing.db")
+	if table, err := dbOpenExisting(filename); err == nil {
+		dbClose(table)
+		t.Fatal("dbOpenExisting of a missing file returned no error")
+	}
+	if _, err := os.Stat(filename); !os.IsNotExist(err) {
+		t.Fatalf("dbOpenExisting created %s", filename)
+	}
+
+	out, code := runMain(t, "", "-existing", filename)
+	if code != 1 || !strings.HasPrefix(out, "Error: ") {
+		t.Fatalf("-existing on a missing file: output %q, exit code %d", out, code)
+	}
+	if _, err := os.Stat(filename); !os.IsNotExist(err) {
+		t.Fatalf("-existing created %s", filename)
+	}
+}
+
+func TestModeInsertReinserts(t *testing.T) {
+	source := openTestSession(t, filepath.Join(t.TempDir(), "source.db"))
+	for id := uint32(1); id <= 20; id++ {
+		insertRows(t, source.table, id)
+	}
+	runInput(t, source, ".mode insert")
+	out := runInput(t, source, "select where id > 15")
+
+	statements, ok := strings.CutSuffix(out, "executed.\n")
+	if !ok {
+		t.Fatalf("select printed %q", out)
+	}
+	target := openTestSession(t, filepath.Join(t.TempDir(), "target.db"))
+	for _, line := range strings.Split(strings.TrimSuffix(statements, "\n"), "\n") {
+		if result := runInput(t, target, line); result != "executed.\n" {
+			t.Fatalf("re-inserting %q printed %q", line, result)
+		}
+	}
+	var want strings.Builder
+	for id := 16; id <= 20; id++ {
+		fmt.Fprintf(&want, "insert %d user%d person%d@example.com\n", id, id, id)
+	}
+	if got := dumpOf(t, target.table); got != want.String() {
+		t.Fatalf("re-inserted table dumps as\n%s\nwant\n%s", got, want.String())
+	}
+}
+
+// prepareTest parses input, failing the test if it does not parse.
+func prepareTest(t *testing.T, input string) *Statement {
+	t.Helper()
+	statement := &Statement{}
+	if result := prepareStatement(&InputBuffer{buffer: input}, statement); result != PREPARE_SUCCESS {
+		t.Fatalf("prepare %q: %s", input, prepareErrorMessage(result, input))
+	}
+	return statement
+}
+
+func TestSelectWhereIdGreater(t *testing.T) {
+	table := openTestTable(t)
+	table.leafNodeMaxCells = 3
+	table.internalNodeMaxCells = 3
+	for id := uint32(2); id <= 40; id += 2 {
+		insertRows(t, table, id)
+	}
+
+	tests := []struct {
+		input string
+		first uint32
+	}{
+		{"select where id > 10", 12},
+		{"select where id >= 10", 10},
+		{"select where id > 11", 12},
+		{"select where id >= 11", 12},
+		{"select where id > 0", 2},
+	}
+	for _, test := range tests {
+		cursor, err := selectStart(prepareTest(t, test.input), table)
+		if err != nil {
+			t.Fatal(err)
+		}
+		want, err := tableFind(table, test.first)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if cursor.pageNum != want.pageNum || cursor.cellNum != want.cellNum {
+			t.Errorf("%q starts at page %d cell %d, want page %d cell %d (key %d)",
+				test.input, cursor.pageNum, cursor.cellNum, want.pageNum, want.cellNum, test.first)
+		}
+
+		var rows strings.Builder
+		for id := test.first; id <= 40; id += 2 {
+			fmt.Fprintf(&rows, "(%d user%d person%d@example.com)\n", id, id, id)
+		}
+		rows.WriteString("executed.\n")
+		if out := runStatement(t, table, test.input); out != rows.String() {
+			t.Errorf("%q printed\n%s\nwant\n%s", test.input, out, rows.String())
+		}
+	}
+
+	cursor, err := selectStart(prepareTest(t, "select where id > 40"), table)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !cursor.endOfTable {
+		t.Error("select where id > the largest key did not start at the end of the table")
+	}
+}
+
+// selectedIds runs a plain select and returns the ids it printed, in order.
+func selectedIds(t *testing.T, table *Table) []uint32 {
+	t.Helper()
+	return selectIds(t, table, "select")
+}
+
+func checkAscending(t *testing.T, ids []uint32, want int) {
+	t.Helper()
+	if len(ids) != want {
+		t.Fatalf("select printed %d rows, want %d", len(ids), want)
+	}
+	for i := 1; i < len(ids); i++ {
+		if ids[i] <= ids[i-1] {
+			t.Fatalf("select printed id %d after %d", ids[i], ids[i-1])
+		}
+	}
+}
+
+func TestSelectIsInAscendingIdOrder(t *testing.T) {
+	t.Run("random inserts", func(t *testing.T) {
+		table := openTestTable(t)
+		table.leafNodeMaxCells = 3
+		table.internalNodeMaxCells = 3
+		rng := rand.New(rand.NewSource(1))
+		for _, id := range rng.Perm(100) {
+			insertRows(t, table, uint32(id)+1)
+		}
+		checkAscending(t, selectedIds(t, table), 100)
+	})
+
+	t.Run("interleaved deletes", func(t *testing.T) {
+		table := openTestTable(t)
+		table.leafNodeMaxCells = 3
+		table.internalNodeMaxCells = 3
+		rng := rand.New(rand.NewSource(2))
+		present := map[uint32]bool{}
+		// Pages a merge drops are not reused, so the churn is kept small
+		// enough to stay within TABLE_MAX_PAGES.
+		for i := 0; i < 200; i++ {
+			id := uint32(rng.Intn(50)) + 1
+			if present[id] {
+				deleteRow(t, table, id)
+				delete(present, id)
+			} else {
+				insertRows(t, table, id)
+				present[id] = true
+			}
+			if i%20 == 0 {
+				checkAscending(t, selectedIds(t, table), len(present))
+			}
+		}
+		checkAscending(t, selectedIds(t, table), len(present))
+		checkTreeOK(t, table)
+	})
+}
+
+func TestDuplicatePolicy(t *testing.T) {
+	tests := []struct {
+		policy string
+		out    string
+		row    string
+	}{
+		{"error", "Error: Duplicate key\n", "(1 old old@example.com)\n"},
+		{"ignore", "executed.\n", "(1 old old@example.com)\n"},
+		{"replace", "executed.\n", "(1 new new@example.com)\n"},
+	}
+	for _, test := range tests {
+		t.Run(test.policy, func(t *testing.T) {
+			table := openTestTable(t)
+			policy, err := parseDuplicatePolicy(test.policy)
+			if err != nil {
+				t.Fatal(err)
+			}
+			table.duplicatePolicy = policy
+			runStatement(t, table, "insert 1 old old@example.com")
+			runStatement(t, table, "insert 2 two two@example.com")
+			if out := runStatement(t, table, "insert 1 new new@example.com"); out != test.out {
+				t.Errorf("duplicate insert printed %q, want %q", out, test.out)
+			}
+			if out := runStatement(t, table, "select where id = 1"); out != test.row+"executed.\n" {
+				t.Errorf("row 1 is now %q, want %q", out, test.row)
+			}
+			checkKeys(t, table, map[uint32]bool{1: true, 2: true})
+		})
+	}
+
+	if _, err := parseDuplicatePolicy("merge"); err == nil {
+		t.Error("parseDuplicatePolicy accepted an unknown policy")
+	}
+}
+
+func TestColumnSizeBoundaries(t *testing.T) {
+	table := openTestTable(t)
+	id := 0
+	columns := []struct {
+		name string
+		size int
+		row  func(value string) (username, email string)
+	}{
+		{"username", COLUMN_USERNAME_SIZE, func(value string) (string, string) { return value, "e@example.com" }},
+		{"email", COLUMN_EMAIL_SIZE, func(value string) (string, string) { return "u", value }},
+	}
+	for _, column := range columns {
+		for _, length := range []int{column.size - 1, column.size, column.size + 1} {
+			id++
+			username, email := column.row(strings.Repeat("x", length))
+			input := fmt.Sprintf("insert %d %s %s", id, username, email)
+			result := prepareStatement(&InputBuffer{buffer: input}, &Statement{})
+			if length > column.size {
+				if result != PREPARE_STRING_TOO_LONG {
+					t.Errorf("%s of %d bytes: prepare result %d, want PREPARE_STRING_TOO_LONG", column.name, length, result)
+				}
+				continue
+			}
+			if result != PREPARE_SUCCESS {
+				t.Fatalf("%s of %d bytes: prepare result %d", column.name, length, result)
+			}
+			runStatement(t, table, input)
+			want := fmt.Sprintf("(%d %s %s)\nexecuted.\n", id, username, email)
+			if out := runStatement(t, table, fmt.Sprintf("select where id = %d", id)); out != want {
+				t.Errorf("%s of %d bytes read back as %q, want %q", column.name, length, out, want)
+			}
+		}
+	}
+}
+
+func TestSelectProjection(t *testing.T) {
+	table := openTestTable(t)
+	runStatement(t, table, "insert 1 alice alice@example.com")
+	tests := []struct {
+		input string
+		want  string
+	}{
+		{"select", "(1 alice alice@example.com)\nexecuted.\n"},
+		{"select *", "(1 alice alice@example.com)\nexecuted.\n"},
+		{"select id", "(1)\nexecuted.\n"},
+		{"select email, id", "(alice@example.com 1)\nexecuted.\n"},
+		{"select from users", "Syntax error. couldn't parse statement\n"},
+		{"select garbage", "Syntax error. couldn't parse statement\n"},
+	}
+	for _, test := range tests {
+		if out := runStatement(t, table, test.input); out != test.want {
+			t.Errorf("%q printed %q, want %q", test.input, out, test.want)
+		}
+	}
+}
+
+func writeScript(t *testing.T, lines ...string) string {
+	t.Helper()
+	filename := filepath.Join(t.TempDir(), "script.sql")
+	if err := os.WriteFile(filename, []byte(strings.Join(lines, "\n")+"\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return filename
+}
+
+func TestCheckScript(t *testing.T) {
+	script := writeScript(t,
+		"insert 1 a a@example.com",
+		"insert 2 b",
+		"insert 3 c c@example.com",
+	)
+	database := filepath.Join(t.TempDir(), "test.db")
+	out, code := runMain(t, "", "-check", script, database)
+	want := script + ":2: Syntax error. couldn't parse statement\n"
+	if out != want || code != 1 {
+		t.Fatalf("output %q, exit code %d; want %q, 1", out, code, want)
+	}
+	if _, err := os.Stat(database); !os.IsNotExist(err) {
+		t.Fatal("-check created the database file")
+	}
+}
+
+func TestCheckScriptStatementTooLarge(t *testing.T) {
+	/* 51 bytes, one over the limit below */
+	long := "insert 2 bob " + strings.Repeat("b", 26) + "@example.com"
+	huge := "insert 4 " + strings.Repeat("u", 100000) + " u@example.com"
+	script := writeScript(t,
+		"insert 1 a a@example.com",
+		long,
+		"insert 3 c",
+		huge,
+		"insert 5",
+	)
+	database := filepath.Join(t.TempDir(), "test.db")
+
+	out, code := runMain(t, "", "-max-statement-bytes", "50", "-check", script, database)
+	want := script + ":2: statement too large, the limit is 50 bytes\n" +
+		script + ":3: Syntax error. couldn't parse statement\n" +
+		script + ":4: statement too large, the limit is 50 bytes\n"
+	if out != want || code != 1 {
+		t.Fatalf("output %q, exit code %d; want %q, 1", out, code, want)
+	}
+
+	/* Under the default limit a line past bufio's 64KB default still parses */
+	out, code = runMain(t, "", "-check", script, database)
+	want = script + ":3: Syntax error. couldn't parse statement\n" +
+		script + ":4: Error: value for column 'username' is 100000 bytes, exceeds 32\n" +
+		script + ":5: Syntax error. couldn't parse statement\n"
+	if out != want || code != 1 {
+		t.Fatalf("output %q, exit code %d; want %q, 1", out, code, want)
+	}
+}
+
+func TestRunScriptSkipsCommentsAndBlankLines(t *testing.T) {
+	script := writeScript(t,
+		"-- seed two users",
+		"",
+		"insert 1 a a@example.com;",
+		"   ",
+		"  -- indented comment",
+		";",
+		"insert 2 b b@example.com",
+	)
+	session := openTestSession(t, filepath.Join(t.TempDir(), "test.db"))
+	var err error
+	out := captureOutput(t, func() {
+		err = runScript(script, session)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if out != "executed.\nexecuted.\n" {
+		t.Fatalf("script printed %q, want two executed lines", out)
+	}
+	checkKeys(t, session.table, map[uint32]bool{1: true, 2: true})
+}
+
+func TestInsertErrorMessages(t *testing.T) {
+	table := openTestTable(t)
+	tests := []struct {
+		input string
+		want  string
+	}{
+		{"insert 1 a a@example.com extra", "Syntax error. too many values, expected: insert <id> <username> <email>\n"},
+		{"explain insert 1 a b c", "Syntax error. too many values, expected: insert <id> <username> <email>\n"},
+		{"insert 1 " + strings.Repeat("u", 33) + " a@example.com", "Error: value for column 'username' is 33 bytes, exceeds 32\n"},
+		{"insert 1 a " + strings.Repeat("e", 256), "Error: value for column 'email' is 256 bytes, exceeds 255\n"},
+	}
+	for _, test := range tests {
+		if out := runStatement(t, table, test.input); out != test.want {
+			t.Errorf("%.40q... printed %q, want %q", test.input, out, test.want)
+		}
+	}
+	checkKeys(t, table, map[uint32]bool{})
+}
+
+// TestInsertLandsInItsLeaf inserts a random permutation into a tree with
+// fan-out 3, so most inserts go through an internal root, and checks that
+// each id is found again in a leaf cell holding it.
+func TestInsertLandsInItsLeaf(t *testing.T) {
+	table := openTestTable(t)
+	table.leafNodeMaxCells = 3
+	table.internalNodeMaxCells = 3
+	rng := rand.New(rand.NewSource(11))
+	ids := rng.Perm(60)
+	for _, id := range ids {
+		insertRows(t, table, uint32(id))
+	}
+	if treeHeight(t, table) < 3 {
+		t.Fatal("the tree did not reach three levels")
+	}
+	checkTreeOK(t, table)
+	var row Row
+	for _, id := range ids {
+		cursor, err := tableFind(table, uint32(id))
+		if err != nil {
+			t.Fatal(err)
+		}
+		node := mustGetPage(t, table.pager, cursor.pageNum)
+		if getNodeType(node) != NODE_LEAF {
+			t.Fatalf("tableFind(%d) returned internal page %d", id, cursor.pageNum)
+		}
+		if cursor.cellNum >= leafNodeNumcells(node) || leafNodeKey(node, cursor.cellNum) != uint32(id) {
+			t.Fatalf("tableFind(%d) points at cell %d of page %d, which does not hold it", id, cursor.cellNum, cursor.pageNum)
+		}
+		deserializeRow(&row, leafNodeValue(node, cursor.cellNum))
+		if row.id != uint32(id) || row.username != fmt.Sprintf("user%d", id) {
+			t.Fatalf("the cell for id %d holds row %d %q", id, row.id, row.username)
+		}
+	}
+}
+
+func TestGetNodeMinKey(t *testing.T) {
+	table := openTestTable(t)
+	table.leafNodeMaxCells = 3
+	table.internalNodeMaxCells = 3
+	rng := rand.New(rand.NewSource(3))
+	for _, id := range rng.Perm(60) {
+		insertRows(t, table, uint32(id)*3+5)
+	}
+	if treeHeight(t, table) < 3 {
+		t.Fatal("the tree did not reach three levels")
+	}
+
+	check := func() {
+		t.Helper()
+		keys, err := tableKeys(table)
+		if err != nil {
+			t.Fatal(err)
+		}
+		root := mustGetPage(t, table.pager, table.rootPageNum)
+		got, err := getNodeMinKey(table.pager, root)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if want := slices.Min(keys); got != want {
+			t.Fatalf("getNodeMinKey = %d, full scan minimum %d", got, want)
+		}
+	}
+	check()
+	for _, id := range []uint32{5, 8, 11} {
+		deleteRow(t, table, id)
+		check()
+	}
+
+	empty := make([]byte, PAGE_SIZE)
+	initializeInternalNode(empty)
+	if _, err := getNodeMinKey(table.pager, empty); err == nil {
+		t.Error("getNodeMinKey of an internal node with no children returned no error")
+	}
+	initializeLeafNode(empty)
+	if _, err := getNodeMinKey(table.pager, empty); err == nil {
+		t.Error("getNodeMinKey of an empty leaf returned no error")
+	}
+}
+
+func TestConfiguredPrompt(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "test.db")
+	out, code := runMain(t, "select\n", "-prompt", "db> ", filename)
+	if want := "db> executed.\ndb> \n"; out != want || code != 0 {
+		t.Fatalf("output %q, exit code %d; want %q, 0", out, code, want)
+	}
+
+	t.Setenv("TINYSQL_PROMPT", "env> ")
+	if got := defaultPrompt(); got != "env> " {
+		t.Fatalf("defaultPrompt with TINYSQL_PROMPT set = %q", got)
+	}
+}
+
+func TestCyclesAreReported(t *testing.T) {
+	table := openTestTable(t)
+	table.leafNodeMaxCells = 3
+	table.internalNodeMaxCells = 3
+	for id := uint32(1); treeHeight(t, table) < 3; id++ {
+		insertRows(t, table, id)
+	}
+	keys, err := tableKeys(table)
+	if err != nil {
+		t.Fatal(err)
+	}
+	maxKey := keys[len(keys)-1]
+
+	// Point the rightmost internal node's right child back at the root.
+	root := mustGetPage(t, table.pager, table.rootPageNum)
+	node := mustGetPage(t, table.pager, internalNodeRightChild(root))
+	rightChild := internalNodeRightChild(node)
+	setInternalNodeRightChild(node, table.rootPageNum)
+	if err := checkTree(table); err == nil || !strings.Contains(err.Error(), "cycle") {
+		t.Errorf("checkTree: %v, want a cycle", err)
+	}
+	if _, err := tableFind(table, maxKey); err == nil || !strings.Contains(err.Error(), "cycle") {
+		t.Errorf("tableFind: %v, want a cycle", err)
+	}
+	if _, err := treeStats(table); err == nil || !strings.Contains(err.Error(), "cycle") {
+		t.Errorf("treeStats: %v, want a cycle", err)
+	}
+	for _, command := range []string{".btree", ".dot " + filepath.Join(t.TempDir(), "tree.dot"), "select order by id desc"} {
+		if out := runStatement(t, table, command); !strings.Contains(out, "Error: cycle") {
+			t.Errorf("%s printed %q, want a cycle error", command, out)
+		}
+	}
+	setInternalNodeRightChild(node, rightChild)
+	checkTreeOK(t, table)
+
+	// Link the last leaf back to the first.
+	first, err := tableStart(table)
+	if err != nil {
+		t.Fatal(err)
+	}
+	last, err := tableFind(table, maxKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lastLeaf := mustGetPage(t, table.pager, last.pageNum)
+	setLeafNodeNextLeaf(lastLeaf, first.pageNum)
+	if err := checkTree(table); err == nil || !strings.Contains(err.Error(), "cycle") {
+		t.Errorf("checkTree with a looping leaf chain: %v, want a cycle", err)
+	}
+	if out := runStatement(t, table, "select"); !strings.Contains(out, "Error: cycle in leaf chain") {
+		t.Errorf("select over a looping leaf chain ended with %q", out[max(0, len(out)-80):])
+	}
+	setLeafNodeNextLeaf(lastLeaf, 0)
+}
+
+// Ascending keys always land at the end of the rightmost leaf, so every
+// split is the right-child case at each level.
+func TestAscendingInserts(t *testing.T) {
+	table := openTestTable(t)
+	table.leafNodeMaxCells = 3
+	table.internalNodeMaxCells = 3
+	var id uint32
+	for id = 1; treeHeight(t, table) < 4; id++ {
+		insertRows(t, table, id)
+		checkTreeOK(t, table)
+	}
+	checkAscending(t, selectedIds(t, table), int(id-1))
+	if out := runStatement(t, table, ".check"); out != "Tree OK.\n" {
+		t.Fatalf(".check printed %q", out)
+	}
+}
+
+func TestLimitTruncatesSelect(t *testing.T) {
+	session := openTestSession(t, filepath.Join(t.TempDir(), "test.db"))
+	for id := uint32(1); id <= 100; id++ {
+		insertRows(t, session.table, id)
+	}
+	runInput(t, session, ".limit 10")
+	var want strings.Builder
+	for id := 1; id <= 10; id++ {
+		fmt.Fprintf(&want, "(%d user%d person%d@example.com)\n", id, id, id)
+	}
+	want.WriteString("... (truncated)\nexecuted.\n")
+	if out := runInput(t, session, "select"); out != want.String() {
+		t.Fatalf("select with .limit 10 printed\n%s\nwant\n%s", out, want.String())
+	}
+
+	runInput(t, session, ".limit 0")
+	out := runInput(t, session, "select")
+	if strings.Contains(out, "truncated") || strings.Count(out, "\n") != 101 {
+		t.Fatalf("select with .limit 0 printed %d lines", strings.Count(out, "\n"))
+	}
+}
+
+func TestDotExport(t *testing.T) {
+	table := openTestTable(t)
+	table.leafNodeMaxCells = 3
+	insertRows(t, table, 1, 2, 3, 4)
+	filename := filepath.Join(t.TempDir(), "tree.dot")
+	if out := runStatement(t, table, ".dot "+filename); out != "" {
+		t.Fatalf(".dot printed %q", out)
+	}
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dot := string(data)
+	for _, want := range []string{
+		"digraph btree {\n",
+		`  page0 [label="internal | 2"];`,
+		`  page0 -> page2 [label="2"];`,
+		`  page0 -> page1 [label="1"];`,
+		`  page2 [label="leaf | 1 | 2"];`,
+		`  page1 [label="leaf | 3 | 4"];`,
+	} {
+		if !strings.Contains(dot, want) {
+			t.Errorf(".dot output lacks %q:\n%s", want, dot)
+		}
+	}
+}
+
+// There is no eviction, so the test drops every cached page by hand after
+// the checkpoint, forcing the select to read them back from the file.
+func TestReadAfterCheckpoint(t *testing.T) {
+	table := openTestTable(t)
+	table.leafNodeMaxCells = 3
+	table.internalNodeMaxCells = 3
+	for id := uint32(1); id <= 20; id++ {
+		insertRows(t, table, id)
+	}
+	before := selectedIds(t, table)
+	if out := runStatement(t, table, ".checkpoint"); out != "" {
+		t.Fatalf(".checkpoint printed %q", out)
+	}
+	for i := range table.pager.pages {
+		table.pager.pages[i] = nil
+	}
+	if after := selectedIds(t, table); !slices.Equal(after, before) {
+		t.Fatalf("after the checkpoint select printed %v, want %v", after, before)
+	}
+	insertRows(t, table, 21)
+	checkAscending(t, selectedIds(t, table), 21)
+	checkTreeOK(t, table)
+}
+
+func TestFastload(t *testing.T) {
+	session := openTestSession(t, filepath.Join(t.TempDir(), "test.db"))
+	session.table.leafNodeMaxCells = 3
+	session.table.internalNodeMaxCells = 3
+	runInput(t, session, ".fastload on")
+	for id := 1; id <= 60; id++ {
+		if out := runInput(t, session, fmt.Sprintf("insert %d user%d person%d@example.com", id, id, id)); out != "executed.\n" {
+			t.Fatalf("fastload insert %d printed %q", id, out)
+		}
+	}
+	checkTreeOK(t, session.table)
+	checkAscending(t, selectedIds(t, session.table), 60)
+
+	for _, id := range []int{60, 30} {
+		want := fmt.Sprintf("Error: fastload needs increasing ids: %d is not above 60\n", id)
+		if out := runInput(t, session, fmt.Sprintf("insert %d x x@example.com", id)); out != want {
+			t.Errorf("fastload insert %d printed %q, want %q", id, out, want)
+		}
+	}
+	checkAscending(t, selectedIds(t, session.table), 60)
+}
+
+// benchmarkLoad times loading 500 ascending rows into a fresh table.
+func benchmarkLoad(b *testing.B, execute func(*Statement, *Table) (ExecuteResult, error)) {
+	for i := 0; i < b.N; i++ {
+		table, err := dbOpen(filepath.Join(b.TempDir(), "bench.db"))
+		if err != nil {
+			b.Fatal(err)
+		}
+		for id := uint32(1); id <= 500; id++ {
+			statement := &Statement{typ: STATEMENT_INSERT, rowToInsert: Row{id: id, username: "user", email: "user@example.com"}}
+			if result, err := execute(statement, table); result != EXECUTE_SUCCESS || err != nil {
+				b.Fatalf("insert %d: result %d, %v", id, result, err)
+			}
+		}
+		if err := dbClose(table); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkInsertAscending(b *testing.B) {
+	benchmarkLoad(b, executeInsert)
+}
+
+func BenchmarkFastloadAscending(b *testing.B) {
+	benchmarkLoad(b, executeAppend)
+}
+
+func TestTreeStats(t *testing.T) {
+	table := openTestTable(t)
+	table.leafNodeMaxCells = 3
+	table.internalNodeMaxCells = 3
+	insertRows(t, table, 1, 2, 3, 4)
+	stats, err := treeStats(table)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := TreeStats{height: 2, internalPages: 1, leafPages: 2, rows: 4, leafFill: 4.0 / 6}
+	if *stats != want {
+		t.Fatalf("treeStats = %+v, want %+v", *stats, want)
+	}
+
+	// Splits and merges both leave every leaf at least (max+1)/2 full.
+	minFill := float64(leafNodeMinCells(table)) / float64(table.leafNodeMaxCells)
+	checkStats := func(rows int) {
+		t.Helper()
+		stats, err := treeStats(table)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if stats.rows != uint32(rows) {
+			t.Fatalf("treeStats counts %d rows, want %d", stats.rows, rows)
+		}
+		if stats.leafFill < minFill || stats.leafFill > 1 {
+			t.Fatalf("leaf fill %.2f is outside [%.2f, 1]", stats.leafFill, minFill)
+		}
+	}
+	rng := rand.New(rand.NewSource(4))
+	ids := rng.Perm(60)
+	for _, id := range ids {
+		insertRows(t, table, uint32(id)+10)
+	}
+	checkStats(64)
+	for _, id := range ids[:40] {
+		deleteRow(t, table, uint32(id)+10)
+	}
+	checkStats(24)
+}
+
+func TestConstantSelect(t *testing.T) {
+	table := openTestTable(t)
+	runStatement(t, table, "insert 1 a a@example.com")
+	tests := []struct {
+		input string
+		want  string
+	}{
+		{"select 1", "(1)\nexecuted.\n"},
+		{"select 'x'", "(x)\nexecuted.\n"},
+		{"select 1 + 2", "(3)\nexecuted.\n"},
+		{"select 7 - 10", "(-3)\nexecuted.\n"},
+		{"select 'hello world'", "(hello world)\nexecuted.\n"},
+	}
+	for _, test := range tests {
+		if out := runStatement(t, table, test.input); out != test.want {
+			t.Errorf("%q printed %q, want %q", test.input, out, test.want)
+		}
+	}
+}
+
+func TestTableKeys(t *testing.T) {
+	table := openTestTable(t)
+	table.leafNodeMaxCells = 3
+	table.internalNodeMaxCells = 3
+	rng := rand.New(rand.NewSource(5))
+	for _, id := range rng.Perm(50) {
+		insertRows(t, table, uint32(id)*2+1)
+	}
+	keys, err := tableKeys(table)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkAscending(t, keys, 50)
+	if ids := selectedIds(t, table); !slices.Equal(keys, ids) {
+		t.Fatalf("tableKeys = %v, select printed %v", keys, ids)
+	}
+}
+
+func TestIdZero(t *testing.T) {
+	table := openTestTable(t)
+	table.leafNodeMaxCells = 3
+	insertRows(t, table, 5, 0, 9, 2, 7)
+	cursor, err := tableStart(table)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cursor.endOfTable {
+		t.Fatal("tableStart is at the end of a table holding id 0")
+	}
+	if key, err := cursorKey(cursor); err != nil || key != 0 {
+		t.Fatalf("tableStart is at key %d, %v; want 0", key, err)
+	}
+	if ids := selectedIds(t, table); !slices.Equal(ids, []uint32{0, 2, 5, 7, 9}) {
+		t.Fatalf("select printed ids %v", ids)
+	}
+}
+
+func TestRelinkRepairsLeafChain(t *testing.T) {
+	table := openTestTable(t)
+	table.leafNodeMaxCells = 3
+	table.internalNodeMaxCells = 3
+	for id := uint32(1); id <= 30; id++ {
+		insertRows(t, table, id)
+	}
+	first, err := tableStart(table)
+	if err != nil {
+		t.Fatal(err)
+	}
+	setLeafNodeNextLeaf(mustGetPage(t, table.pager, first.pageNum), 0)
+	if ids := selectedIds(t, table); len(ids) == 30 {
+		t.Fatal("cutting the leaf chain did not shorten the scan")
+	}
+	if err := checkTree(table); err == nil {
+		t.Fatal("checkTree accepted a cut leaf chain")
+	}
+
+	if out := runStatement(t, table, ".relink"); out != "" {
+		t.Fatalf(".relink printed %q", out)
+	}
+	checkTreeOK(t, table)
+	checkAscending(t, selectedIds(t, table), 30)
+}
+
+func TestTablesOnOneFileSharePages(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "test.db")
+	first, err := dbOpen(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, err := dbOpen(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if first.pager != second.pager {
+		t.Fatal("two opens of one file have separate pagers")
+	}
+	insertRows(t, first, 1)
+	insertRows(t, second, 2)
+	for _, table := range []*Table{first, second} {
+		checkKeys(t, table, map[uint32]bool{1: true, 2: true})
+	}
+
+	if err := dbClose(first); err != nil {
+		t.Fatal(err)
+	}
+	insertRows(t, second, 3)
+	checkKeys(t, second, map[uint32]bool{1: true, 2: true, 3: true})
+	if err := dbClose(second); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := openPagers[filename]; ok {
+		t.Fatal("the pager outlived the last table using it")
+	}
+	if keys := fileKeys(t, filename); !slices.Equal(keys, []uint32{1, 2, 3}) {
+		t.Fatalf("file holds %v after both tables closed, want [1 2 3]", keys)
+	}
+}
+
+// Every statement that takes a row names the column that overflowed.
+func TestTooLongErrorNamesColumn(t *testing.T) {
+	table := openTestTable(t)
+	runStatement(t, table, "insert 1 a a@example.com")
+	longUsername := strings.Repeat("u", COLUMN_USERNAME_SIZE+8)
+	longEmail := strings.Repeat("e", COLUMN_EMAIL_SIZE+45)
+	usernameError := "Error: value for column 'username' is 40 bytes, exceeds 32\n"
+	emailError := "Error: value for column 'email' is 300 bytes, exceeds 255\n"
+	for _, verb := range []string{"insert", "update", "explain insert"} {
+		if out := runStatement(t, table, verb+" 1 "+longUsername+" a@example.com"); out != usernameError {
+			t.Errorf("%s with a long username printed %q, want %q", verb, out, usernameError)
+		}
+		if out := runStatement(t, table, verb+" 1 a "+longEmail); out != emailError {
+			t.Errorf("%s with a long email printed %q, want %q", verb, out, emailError)
+		}
+	}
+	if out := runStatement(t, table, "select"); out != "(1 a a@example.com)\nexecuted.\n" {
+		t.Fatalf("the rejected statements changed the table: %q", out)
+	}
+}
+
+func TestNullIdIsRejected(t *testing.T) {
+	table := openTestTable(t)
+	for _, input := range []string{"insert null a a@example.com", "insert NULL a a@example.com"} {
+		if out := runStatement(t, table, input); out != "Error: primary key cannot be NULL\n" {
+			t.Errorf("%q printed %q", input, out)
+		}
+	}
+	if out := runStatement(t, table, "insert -1 a a@example.com"); out != "Syntax error. illegal id\n" {
+		t.Errorf("a negative id printed %q", out)
+	}
+	checkKeys(t, table, map[uint32]bool{})
+}
+
+func TestPageCommand(t *testing.T) {
+	table := openTestTable(t)
+	table.leafNodeMaxCells = 3
+	insertRows(t, table, 1, 2, 3, 4)
+	tests := []struct {
+		input string
+		want  string
+	}{
+		{".page 1", "leaf page 1 (size 2, root false, parent 0, next leaf 0)\n" +
+			"   -  0 : 3 (3 user3 person3@example.com)\n" +
+			"   -  1 : 4 (4 user4 person4@example.com)\n"},
+		{".page 0", "internal page 0 (size 1, root true, parent 0)\n" +
+			"   -  child 2, key 2\n" +
+			"   -  right child 1\n"},
+		{".page 3", "Error: page 3 does not exist, the file has 3 pages\n"},
+	}
+	for _, test := range tests {
+		if out := runStatement(t, table, test.input); out != test.want {
+			t.Errorf("%s printed\n%s\nwant\n%s", test.input, out, test.want)
+		}
+	}
+}
+
+// crash drops table's pager the way a killed process would: the file is
+// closed without the cached pages being written.
+func crash(t *testing.T, table *Table) {
+	t.Helper()
+	if err := table.pager.file.Close(); err != nil {
+		t.Fatal(err)
+	}
+	delete(openPagers, table.pager.path)
+}
+
+func TestRecoverFromCheckpoint(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "test.db")
+	table, err := dbOpen(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	table.leafNodeMaxCells = 3
+	table.internalNodeMaxCells = 3
+	want := map[uint32]bool{}
+	for id := uint32(1); id <= 20; id++ {
+		insertRows(t, table, id)
+		want[id] = true
+	}
+	if err := dbCheckpoint(table); err != nil {
+		t.Fatal(err)
+	}
+	// Enough more rows to split leaves the checkpoint already wrote.
+	for id := uint32(21); id <= 40; id++ {
+		insertRows(t, table, id)
+	}
+	deleteRow(t, table, 3)
+	crash(t, table)
+
+	table, err = dbOpenExisting(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dbClose(table)
+	table.leafNodeMaxCells = 3
+	table.internalNodeMaxCells = 3
+	if out := runStatement(t, table, ".check"); out != "Tree OK.\n" {
+		t.Fatalf(".check after recovery printed %q", out)
+	}
+	checkKeys(t, table, want)
+}
+
+// checkFreedCellsZero fails if any leaf in the tree, or any page the tree
+// no longer uses, holds a non-zero byte past its last cell.
+func checkFreedCellsZero(t *testing.T, table *Table) {
+	t.Helper()
+	inUse := map[uint32]bool{}
+	treePages(t, table.pager, table.rootPageNum, inUse)
+	for pageNum := uint32(0); pageNum < table.pager.numPages; pageNum++ {
+		page := mustGetPage(t, table.pager, pageNum)
+		from := 0
+		if inUse[pageNum] {
+			if getNodeType(page) != NODE_LEAF {
+				continue
+			}
+			from = len(leafNodeCell(page, 0)) * int(leafNodeNumcells(page))
+			from += LEAF_NODE_HEADER_SIZE
+		}
+		for i := from; i < PAGE_SIZE; i++ {
+			if page[i] != 0 {
+				t.Fatalf("page %d has byte %#02x at offset %d, past its cells", pageNum, page[i], i)
+			}
+		}
+	}
+}
+
+func TestZeroFreedCells(t *testing.T) {
+	table := openTestTable(t)
+	table.zeroFreedCells = true
+	insertRows(t, table, 1, 2, 3)
+	deleteRow(t, table, 2)
+	checkFreedCellsZero(t, table)
+
+	// At fan-out 3 these deletes borrow from a sibling and then merge.
+	table = openTestTable(t)
+	table.zeroFreedCells = true
+	table.leafNodeMaxCells = 3
+	table.internalNodeMaxCells = 3
+	for id := uint32(1); id <= 30; id++ {
+		insertRows(t, table, id)
+	}
+	checkFreedCellsZero(t, table)
+	for id := uint32(1); id <= 30; id += 2 {
+		deleteRow(t, table, id)
+		checkFreedCellsZero(t, table)
+	}
+	checkTreeOK(t, table)
+}
+
+// selectIds runs input and returns the ids of the rows it printed.
+func selectIds(t *testing.T, table *Table, input string) []uint32 {
+	t.Helper()
+	var ids []uint32
+	for _, line := range strings.Split(runStatement(t, table, input), "\n") {
+		var id uint32
+		if _, err := fmt.Sscanf(line, "(%d ", &id); err == nil {
+			ids = append(ids, id)
+		}
+	}
+	return ids
+}
+
+func TestSelectWhereIdNotEqual(t *testing.T) {
+	table := openTestTable(t)
+	table.leafNodeMaxCells = 3
+	var want []uint32
+	for id := uint32(1); id <= 10; id++ {
+		insertRows(t, table, id)
+		if id != 5 {
+			want = append(want, id)
+		}
+	}
+	for _, input := range []string{"select where id <> 5", "select where id != 5"} {
+		if ids := selectIds(t, table, input); !slices.Equal(ids, want) {
+			t.Errorf("%q printed ids %v, want %v", input, ids, want)
+		}
+	}
+	if ids := selectIds(t, table, "select where id <> 50"); len(ids) != 10 {
+		t.Errorf("excluding a missing id printed %d rows, want 10", len(ids))
+	}
+}
+
+func TestNulDisplay(t *testing.T) {
+	session := openTestSession(t, filepath.Join(t.TempDir(), "test.db"))
+	statement := &Statement{typ: STATEMENT_INSERT, rowToInsert: Row{id: 1, username: "ab\x00cd", email: "e@example.com"}}
+	if result, err := executeInsert(statement, session.table); result != EXECUTE_SUCCESS || err != nil {
+		t.Fatalf("insert: result %d, %v", result, err)
+	}
+	tests := []struct {
+		mode string
+		want string
+	}{
+		{"trimmed", "(1 ab e@example.com)\n"},
+		{"raw", "(1 ab\x00cd e@example.com)\n"},
+		{"escaped", `(1 ab\x00cd e@example.com)` + "\n"},
+	}
+	for _, test := range tests {
+		runInput(t, session, ".nul "+test.mode)
+		if out := runInput(t, session, "select"); out != test.want+"executed.\n" {
+			t.Errorf(".nul %s printed %q, want %q", test.mode, out, test.want)
+		}
+	}
+	if out := runInput(t, session, ".nul hex"); out != "Error: unknown nul display: hex\n" {
+		t.Errorf(".nul hex printed %q", out)
+	}
+}
+
+// A freshly opened pager reads pages only as they are asked for, so the
+// pages in its cache after a select are the pages the select touched.
+func TestSelectLimitStopsScan(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "test.db")
+	table, err := dbOpen(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for id := uint32(1); id <= 60; id++ {
+		insertRows(t, table, id)
+	}
+	start, err := tableStart(table)
+	if err != nil {
+		t.Fatal(err)
+	}
+	firstLeafCells := int(leafNodeNumcells(mustGetPage(t, table.pager, start.pageNum)))
+	if err := dbClose(table); err != nil {
+		t.Fatal(err)
+	}
+
+	/* Reopen for each select so only the pages it reads are cached */
+	selectLimit := func(limit int) {
+		t.Helper()
+		table, err := dbOpenExisting(filename)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer dbClose(table)
+		if table.pager.numPages < 4 {
+			t.Fatalf("60 rows took %d pages, too few to tell the leaves apart", table.pager.numPages)
+		}
+		first, err := tableStart(table)
+		if err != nil {
+			t.Fatal(err)
+		}
+		input := fmt.Sprintf("select limit %d", limit)
+		ids := selectIds(t, table, input)
+		if len(ids) != limit || ids[0] != 1 || ids[limit-1] != uint32(limit) {
+			t.Fatalf("%s printed ids %v", input, ids)
+		}
+		for pageNum, page := range table.pager.pages {
+			if page != nil && uint32(pageNum) != table.rootPageNum && uint32(pageNum) != first.pageNum {
+				t.Errorf("%s read page %d, beyond the root and first leaf", input, pageNum)
+			}
+		}
+	}
+	selectLimit(3)
+	/* A limit ending exactly at the end of the first leaf */
+	selectLimit(firstLeafCells)
+}
+
+func TestSelectMixingStarAndColumns(t *testing.T) {
+	for _, input := range []string{"select id, *", "select *, email", "select username, *, id"} {
+		result := prepareStatement(&InputBuffer{buffer: input}, &Statement{})
+		if got := prepareErrorMessage(result, input); got != "Syntax error. cannot combine * with explicit columns" {
+			t.Errorf("%q: %q", input, got)
+		}
+	}
+	for _, input := range []string{"select *", "select id"} {
+		prepareTest(t, input)
+	}
+}
+
+func TestForkIsIndependent(t *testing.T) {
+	table := openTestTable(t)
+	table.leafNodeMaxCells = 3
+	table.internalNodeMaxCells = 3
+	want := map[uint32]bool{}
+	for id := uint32(1); id <= 20; id++ {
+		insertRows(t, table, id)
+		want[id] = true
+	}
+	forkFile := filepath.Join(t.TempDir(), "fork.db")
+	if out := runStatement(t, table, ".fork "+forkFile); out != "" {
+		t.Fatalf(".fork printed %q", out)
+	}
+	if out := runStatement(t, table, ".fork "+forkFile); !strings.HasPrefix(out, "Error: ") {
+		t.Fatalf(".fork over an existing file printed %q", out)
+	}
+
+	fork, err := dbOpenExisting(forkFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dbClose(fork)
+	fork.leafNodeMaxCells = 3
+	fork.internalNodeMaxCells = 3
+	checkKeys(t, fork, want)
+	for id := uint32(1); id <= 10; id++ {
+		deleteRow(t, fork, id)
+	}
+	insertRows(t, fork, 100, 101)
+	runStatement(t, fork, "update 15 changed changed@example.com")
+	checkTreeOK(t, fork)
+
+	checkKeys(t, table, want)
+	if out := runStatement(t, table, "select where id = 15"); out != "(15 user15 person15@example.com)\nexecuted.\n" {
+		t.Fatalf("updating the fork changed the original: %q", out)
+	}
+	checkTreeOK(t, table)
+}
+
+func TestFailedForkLeavesNoFile(t *testing.T) {
+	table := openTestTable(t)
+	insertRows(t, table, 1, 2, 3)
+	forkFile := filepath.Join(t.TempDir(), "fork.db")
+
+	/* Claim a page past TABLE_MAX_PAGES so the copy fails partway through */
+	numPages := table.pager.numPages
+	table.pager.numPages = TABLE_MAX_PAGES + 1
+	err := dbFork(table, forkFile)
+	table.pager.numPages = numPages
+	if err == nil {
+		t.Fatal("dbFork copied a page past TABLE_MAX_PAGES")
+	}
+	if _, err := os.Stat(forkFile); !os.IsNotExist(err) {
+		t.Fatalf("the failed fork left %s behind", forkFile)
+	}
+
+	if err := dbFork(table, forkFile); err != nil {
+		t.Fatalf("retrying the fork: %v", err)
+	}
+	fork, err := dbOpenExisting(forkFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dbClose(fork)
+	checkKeys(t, fork, map[uint32]bool{1: true, 2: true, 3: true})
+}
+
+func TestInsertAtCapacity(t *testing.T) {
+	table := openTestTable(t)
+	table.leafNodeMaxCells = 3
+	table.internalNodeMaxCells = 3
+
+	// Fill in ascending order until the pager runs out of pages.
+	var inserted uint32
+	for id := uint32(1); ; id++ {
+		result := insertRow(t, table, id)
+		if result == EXECUTE_TABLE_FULL {
+			break
+		}
+		if result != EXECUTE_SUCCESS {
+			t.Fatalf("insert %d: result %d", id, result)
+		}
+		inserted = id
+	}
+	if inserted == 0 {
+		t.Fatal("no row fit")
+	}
+	checkTreeOK(t, table)
+
+	numPages := table.pager.numPages
+	before := snapshotPages(t, table.pager)
+	if result := insertRow(t, table, inserted+1); result != EXECUTE_TABLE_FULL {
+		t.Fatalf("insert past capacity: result %d, want EXECUTE_TABLE_FULL", result)
+	}
+	if table.pager.numPages != numPages {
+		t.Fatalf("numPages changed from %d to %d", numPages, table.pager.numPages)
+	}
+	for i, page := range snapshotPages(t, table.pager) {
+		if !bytes.Equal(page, before[i]) {
+			t.Fatalf("page %d changed by a rejected insert", i)
+		}
+	}
+	checkTreeOK(t, table)
+
+	stats, err := treeStats(table)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.rows != inserted {
+		t.Fatalf("tree holds %d rows, want %d", stats.rows, inserted)
+	}
+}
+
+func explainInsertOf(t *testing.T, table *Table, id uint32) *InsertPlan {
+	t.Helper()
+	statement := &Statement{typ: STATEMENT_EXPLAIN_INSERT, rowToInsert: Row{id: id}}
+	plan, err := explainInsert(statement, table)
+	if err != nil {
+		t.Fatalf("explain insert %d: %v", id, err)
+	}
+	return plan
+}
+
+func TestExplainInsert(t *testing.T) {
+	table := openTestTable(t)
+	table.leafNodeMaxCells = 3
+	table.internalNodeMaxCells = 3
+	insertRows(t, table, 10, 20, 30, 40)
+	// Leaves are now {10, 20} and {30, 40}; fill the right one.
+	insertRows(t, table, 50)
+
+	before := snapshotPages(t, table.pager)
+
+	plan := explainInsertOf(t, table, 15)
+	if len(plan.splitPages) != 0 || plan.newPages != 0 {
+		t.Fatalf("insert into a non-full leaf: splits %v, new pages %d", plan.splitPages, plan.newPages)
+	}
+
+	plan = explainInsertOf(t, table, 60)
+	if len(plan.splitPages) != 1 || plan.splitPages[0] != plan.leafPageNum {
+		t.Fatalf("insert into a full leaf: splits %v, want [%d]", plan.splitPages, plan.leafPageNum)
+	}
+	if plan.newPages != 1 {
+		t.Fatalf("insert into a full leaf: new pages %d, want 1", plan.newPages)
+	}
+
+	if plan := explainInsertOf(t, table, 20); !plan.duplicate {
+		t.Fatal("explaining an existing key did not report a duplicate")
+	}
+
+	after := snapshotPages(t, table.pager)
+	if len(after) != len(before) {
+		t.Fatalf("explain changed the page count from %d to %d", len(before), len(after))
+	}
+	for i := range after {
+		if !bytes.Equal(after[i], before[i]) {
+			t.Fatalf("explain changed page %d", i)
+		}
+	}
+
+	// The plan matches what the insert then does.
+	numPages := table.pager.numPages
+	insertRows(t, table, 60)
+	if table.pager.numPages != numPages+plan.newPages {
+		t.Fatalf("insert allocated %d pages, explain said %d", table.pager.numPages-numPages, plan.newPages)
+	}
+	checkTreeOK(t, table)
+}
+
+func TestTableRangeKeys(t *testing.T) {
+	table := openTestTable(t)
+	table.leafNodeMaxCells = 3
+	table.internalNodeMaxCells = 3
+	for id := uint32(2); id <= 60; id += 2 {
+		insertRows(t, table, id)
+	}
+	all, err := tableKeys(table)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ranges := []struct {
+		lo, hi    uint32
+		inclusive bool
+	}{
+		{10, 20, true},
+		{10, 20, false},
+		{11, 19, true},
+		{0, 100, true},
+		{59, 100, true},
+		{61, 100, true},
+		{20, 20, true},
+		{20, 20, false},
+		{30, 10, true},
+	}
+	for _, r := range ranges {
+		got, err := tableRangeKeys(table, r.lo, r.hi, r.inclusive)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var want []uint32
+		for _, key := range all {
+			if key >= r.lo && (key < r.hi || (r.inclusive && key == r.hi)) {
+				want = append(want, key)
+			}
+		}
+		if fmt.Sprint(got) != fmt.Sprint(want) {
+			t.Errorf("tableRangeKeys(%d, %d, %v) = %v, want %v", r.lo, r.hi, r.inclusive, got, want)
+		}
+	}
+}
+
+func TestSelectOrderByIdDescLimit(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "test.db")
+	table, err := dbOpen(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	table.leafNodeMaxCells = 3
+	table.internalNodeMaxCells = 3
+	for id := uint32(1); id <= 100; id++ {
+		insertRows(t, table, id)
+	}
+	if err := dbClose(table); err != nil {
+		t.Fatal(err)
+	}
+
+	/* Each reopen starts with an empty cache, so the cached pages are the ones read */
+	cachedPages := func(run func(table *Table)) map[uint32]bool {
+		t.Helper()
+		table, err := dbOpenExisting(filename)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer dbClose(table)
+		run(table)
+		pages := map[uint32]bool{}
+		for pageNum, page := range table.pager.pages {
+			if page != nil {
+				pages[uint32(pageNum)] = true
+			}
+		}
+		return pages
+	}
+
+	read := cachedPages(func(table *Table) {
+		out := runStatement(t, table, "select id order by id desc limit 10")
+		var want strings.Builder
+		for id := 100; id > 90; id-- {
+			fmt.Fprintf(&want, "(%d)\n", id)
+		}
+		want.WriteString("executed.\n")
+		if out != want.String() {
+			t.Fatalf("got:\n%s\nwant:\n%s", out, want.String())
+		}
+	})
+	// The scan reads only the leaves holding those ten rows and the
+	// internal nodes above them.
+	wantRead := cachedPages(func(table *Table) {
+		for id := uint32(91); id <= 100; id++ {
+			if _, err := tableFind(table, id); err != nil {
+				t.Fatal(err)
+			}
+		}
+	})
+	if fmt.Sprint(read) != fmt.Sprint(wantRead) {
+		t.Fatalf("select order by id desc limit 10 read pages %v, want %v", read, wantRead)
+	}
+}
+
+func TestDelete(t *testing.T) {
+	orders := map[string]func(ids []uint32){
+		"ascending":  func(ids []uint32) {},
+		"descending": func(ids []uint32) { slices.Reverse(ids) },
+		"random": func(ids []uint32) {
+			rand.New(rand.NewSource(1)).Shuffle(len(ids), func(i, j int) { ids[i], ids[j] = ids[j], ids[i] })
+		},
+	}
+	for name, order := range orders {
+		t.Run(name, func(t *testing.T) {
+			table := openTestTable(t)
+			table.leafNodeMaxCells = 3
+			table.internalNodeMaxCells = 3
+			present := map[uint32]bool{}
+			var ids []uint32
+			for id := uint32(1); id <= 60; id++ {
+				insertRows(t, table, id)
+				present[id] = true
+				ids = append(ids, id)
+			}
+
+			order(ids)
+			for _, id := range ids {
+				if result := deleteRow(t, table, id); result != EXECUTE_SUCCESS {
+					t.Fatalf("delete %d: result %d", id, result)
+				}
+				delete(present, id)
+				checkTreeOK(t, table)
+				checkKeys(t, table, present)
+				checkMinFill(t, table, table.rootPageNum)
+			}
+
+			root := mustGetPage(t, table.pager, table.rootPageNum)
+			if getNodeType(root) != NODE_LEAF || leafNodeNumcells(root) != 0 {
+				t.Fatal("deleting every row did not leave an empty root leaf")
+			}
+			if result := deleteRow(t, table, 1); result != EXECUTE_KEY_NOT_FOUND {
+				t.Fatalf("delete from an empty table: result %d", result)
+			}
+			insertRows(t, table, 5, 6, 7, 8)
+			checkTreeOK(t, table)
+		})
+	}
+}
+
+func TestDeleteMissingKey(t *testing.T) {
+	table := openTestTable(t)
+	insertRows(t, table, 10, 20)
+	before := snapshotPages(t, table.pager)
+	if result := deleteRow(t, table, 15); result != EXECUTE_KEY_NOT_FOUND {
+		t.Fatalf("delete 15: result %d, want EXECUTE_KEY_NOT_FOUND", result)
+	}
+	for i, page := range snapshotPages(t, table.pager) {
+		if !bytes.Equal(page, before[i]) {
+			t.Fatalf("deleting a missing key changed page %d", i)
+		}
+	}
+	if out := runStatement(t, table, "delete 15"); out != "Error: Key not found\n" {
+		t.Fatalf("delete 15 printed %q", out)
+	}
+}
+
+func TestDeleteBorrowThenMerge(t *testing.T) {
+	table := openTestTable(t)
+	table.leafNodeMaxCells = 3
+	table.internalNodeMaxCells = 3
+	// Leaves {1, 2} and {3, 4, 5} under an internal root.
+	insertRows(t, table, 1, 2, 3, 4, 5)
+	root := mustGetPage(t, table.pager, table.rootPageNum)
+
+	// {2} is too small but cannot hold its sibling's three cells, so it
+	// borrows 3 and the separator moves up to 3.
+	deleteRow(t, table, 1)
+	checkTreeOK(t, table)
+	checkMinFill(t, table, table.rootPageNum)
+	if getNodeType(root) != NODE_INTERNAL || internalNodeNumKeys(root) != 1 || internalNodeKey(root, 0) != 3 {
+		t.Fatal("delete 1 did not borrow from the right sibling")
+	}
+
+	// {3} and {4, 5} fit in one leaf, so they merge and the root, left
+	// with a single child, collapses back into a leaf.
+	deleteRow(t, table, 2)
+	checkTreeOK(t, table)
+	if getNodeType(root) != NODE_LEAF || leafNodeNumcells(root) != 3 {
+		t.Fatal("delete 2 did not merge the leaves into the root")
+	}
+	checkKeys(t, table, map[uint32]bool{3: true, 4: true, 5: true})
+}
+
+func TestDeleteShrinksTree(t *testing.T) {
+	table := openTestTable(t)
+	table.leafNodeMaxCells = 3
+	table.internalNodeMaxCells = 3
+	for id := uint32(1); id <= 60; id++ {
+		insertRows(t, table, id)
+	}
+	height := treeHeight(t, table)
+	if height < 3 {
+		t.Fatalf("60 rows at fan-out 3 gave a tree of height %d, want at least 3", height)
+	}
+
+	// Delete from the middle outwards, so both borrows and merges happen
+	// at every level on the way down.
+	present := map[uint32]bool{}
+	for id := uint32(1); id <= 60; id++ {
+		present[id] = true
+	}
+	for i := uint32(0); i < 57; i++ {
+		id := uint32(30) + i/2 + 1
+		if i%2 == 1 {
+			id = uint32(30) - i/2
+		}
+		if result := deleteRow(t, table, id); result != EXECUTE_SUCCESS {
+			t.Fatalf("delete %d: result %d", id, result)
+		}
+		delete(present, id)
+		checkTreeOK(t, table)
+		checkMinFill(t, table, table.rootPageNum)
+		if h := treeHeight(t, table); h > height {
+			t.Fatalf("tree grew from height %d to %d on delete %d", height, h, id)
+		} else {
+			height = h
+		}
+	}
+	checkKeys(t, table, present)
+	if height != 1 {
+		t.Fatalf("three rows left in a tree of height %d, want 1", height)
+	}
+}
+
+func TestUpdate(t *testing.T) {
+	table := openTestTable(t)
+	table.leafNodeMaxCells = 3
+	table.internalNodeMaxCells = 3
+	insertRows(t, table, 1, 2, 3, 4, 5)
+
+	if out := runStatement(t, table, "update 4 al al@example.com"); out != "executed.\n" {
+		t.Fatalf("update 4 printed %q", out)
+	}
+	if out := runStatement(t, table, "select where id >= 4 limit 1"); out != "(4 al al@example.com)\nexecuted.\n" {
+		t.Fatalf("after update, select printed %q", out)
+	}
+
+	before := snapshotPages(t, table.pager)
+	if out := runStatement(t, table, "update 9 nobody nobody@example.com"); out != "Error: Key not found\n" {
+		t.Fatalf("update 9 printed %q", out)
+	}
+	after := snapshotPages(t, table.pager)
+	if len(after) != len(before) {
+		t.Fatal("updating a missing id allocated pages")
+	}
+	for i := range after {
+		if !bytes.Equal(after[i], before[i]) {
+			t.Fatalf("updating a missing id changed page %d", i)
+		}
+	}
+	checkKeys(t, table, map[uint32]bool{1: true, 2: true, 3: true, 4: true, 5: true})
+	checkTreeOK(t, table)
+}
+
+func TestSelectWhereIdEquals(t *testing.T) {
+	table := openTestTable(t)
+	table.leafNodeMaxCells = 3
+	table.internalNodeMaxCells = 3
+	for id := uint32(2); id <= 80; id += 2 {
+		insertRows(t, table, id)
+	}
+
+	for _, id := range []uint32{2, 40, 42, 80} {
+		out := runStatement(t, table, fmt.Sprintf("select id, username where id = %d", id))
+		want := fmt.Sprintf("(%d user%d)\nexecuted.\n", id, id)
+		if out != want {
+			t.Errorf("select where id = %d printed %q, want %q", id, out, want)
+		}
+	}
+	for _, id := range []uint32{0, 41, 81} {
+		out := runStatement(t, table, fmt.Sprintf("select where id = %d", id))
+		if out != "(no rows)\nexecuted.\n" {
+			t.Errorf("select where id = %d printed %q", id, out)
+		}
+	}
+	if out := runStatement(t, table, "select 42"); out != "(42)\nexecuted.\n" {
+		t.Errorf("select 42 printed %q, want the constant", out)
+	}
+}
+
+func TestSelectRange(t *testing.T) {
+	table := openTestTable(t)
+	table.leafNodeMaxCells = 3
+	table.internalNodeMaxCells = 3
+	for id := uint32(2); id <= 80; id += 2 {
+		insertRows(t, table, id)
+	}
+
+	ranges := []struct{ low, high uint32 }{
+		{10, 20}, // both bounds present
+		{11, 25}, // both bounds fall between keys
+		{1, 80},  // the whole table, across every leaf
+		{79, 200},
+		{81, 200}, // entirely past the end
+		{30, 10},  // empty
+		{40, 40},
+	}
+	for _, r := range ranges {
+		var want strings.Builder
+		for id := uint32(2); id <= 80; id += 2 {
+			if id >= r.low && id <= r.high {
+				fmt.Fprintf(&want, "(%d user%d person%d@example.com)\n", id, id, id)
+			}
+		}
+		want.WriteString("executed.\n")
+		if out := runStatement(t, table, fmt.Sprintf("select %d %d", r.low, r.high)); out != want.String() {
+			t.Errorf("select %d %d printed:\n%s\nwant:\n%s", r.low, r.high, out, want.String())
+		}
+	}
+}
+
+func TestNodeTypeIgnoresNeighbouringHeaderBytes(t *testing.T) {
+	for _, typ := range []Nodetype{NODE_INTERNAL, NODE_LEAF} {
+		node := make([]byte, PAGE_SIZE)
+		for i := range node {
+			node[i] = 0xff
+		}
+		setNodeRoot(node, true)
+		setNodeParent(node, 0xdeadbeef)
+		setNodeType(node, typ)
+		if got := getNodeType(node); got != typ {
+			t.Errorf("getNodeType = %d after setNodeType(%d) with is_root and parent set", got, typ)
+		}
+		if !isNodeRoot(node) || nodeParent(node) != 0xdeadbeef {
+			t.Errorf("setNodeType(%d) changed the is_root byte or parent pointer", typ)
+		}
+	}
+}
+
+// The node slices here start one byte into their buffer, so every
+// multi-byte field sits at an odd address.
+func TestNodeAccessorsAtOddOffsets(t *testing.T) {
+	buf := make([]byte, PAGE_SIZE+1)
+	leaf := buf[1:]
+	initializeLeafNode(leaf)
+	setNodeRoot(leaf, true)
+	setNodeParent(leaf, 0x01020304)
+	setLeafNodeNumcells(leaf, 2)
+	setLeafNodeNextLeaf(leaf, 0x05060708)
+	setLeafNodeKey(leaf, 0, 0x11223344)
+	setLeafNodeKey(leaf, 1, 0x55667788)
+	if getNodeType(leaf) != NODE_LEAF || !isNodeRoot(leaf) {
+		t.Errorf("leaf header: type %d, root %v", getNodeType(leaf), isNodeRoot(leaf))
+	}
+	if got := nodeParent(leaf); got != 0x01020304 {
+		t.Errorf("nodeParent = %#x", got)
+	}
+	if got := leafNodeNumcells(leaf); got != 2 {
+		t.Errorf("leafNodeNumcells = %d", got)
+	}
+	if got := leafNodeNextLeaf(leaf); got != 0x05060708 {
+		t.Errorf("leafNodeNextLeaf = %#x", got)
+	}
+	if got := leafNodeKey(leaf, 0); got != 0x11223344 {
+		t.Errorf("leafNodeKey(0) = %#x", got)
+	}
+	if got := leafNodeKey(leaf, 1); got != 0x55667788 {
+		t.Errorf("leafNodeKey(1) = %#x", got)
+	}
+	if got := buf[1+PARENT_POINTER_OFFSET]; got != 0x04 {
+		t.Errorf("parent pointer is not little-endian at its offset: low byte %#x", got)
+	}
+
+	buf = make([]byte, PAGE_SIZE+1)
+	internal := buf[1:]
+	initializeInternalNode(internal)
+	setNodeRoot(internal, false)
+	setInternalNodeNumKeys(internal, 2)
+	setInternalNodeRightChild(internal, 9)
+	setInternalNodeKey(internal, 0, 0x0a0b0c0d)
+	setInternalNodeKey(internal, 1, 0x0e0f1011)
+	for i, page := range []uint32{7, 8} {
+		if err := setInternalNodeChild(internal, uint32(i), page); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if getNodeType(internal) != NODE_INTERNAL || isNodeRoot(internal) {
+		t.Errorf("internal header: type %d, root %v", getNodeType(internal), isNodeRoot(internal))
+	}
+	if got := internalNodeNumKeys(internal); got != 2 {
+		t.Errorf("internalNodeNumKeys = %d", got)
+	}
+	for i, want := range []uint32{7, 8, 9} {
+		got, err := internalNodeChild(internal, uint32(i))
+		if err != nil || got != want {
+			t.Errorf("internalNodeChild(%d) = %d, %v; want %d", i, got, err, want)
+		}
+	}
+	if got := internalNodeKey(internal, 0); got != 0x0a0b0c0d {
+		t.Errorf("internalNodeKey(0) = %#x", got)
+	}
+	if got := internalNodeKey(internal, 1); got != 0x0e0f1011 {
+		t.Errorf("internalNodeKey(1) = %#x", got)
+	}
+}
+
+// openTestSession starts a session on a fresh database file, closing
+// whichever database it holds when the test ends.
+func openTestSession(t *testing.T, filename string) *Session {
+	t.Helper()
+	table, err := dbOpen(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	session := newSession()
+	session.table = table
+	t.Cleanup(func() {
+		if err := dbClose(session.table); err != nil {
+			t.Error(err)
+		}
+	})
+	return session
+}
+
+// fileKeys reopens filename and returns its keys.
+func fileKeys(t *testing.T, filename string) []uint32 {
+	t.Helper()
+	table, err := dbOpenExisting(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dbClose(table)
+	keys, err := tableKeys(table)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return keys
+}
+
+func TestOpenSwitchesDatabase(t *testing.T) {
+	dir := t.TempDir()
+	first := filepath.Join(dir, "first.db")
+	second := filepath.Join(dir, "second.db")
+	session := openTestSession(t, first)
+
+	runInput(t, session, "insert 1 a a@example.com")
+	if out := runInput(t, session, ".open "+second); out != "" {
+		t.Fatalf(".open printed %q", out)
+	}
+	runInput(t, session, "insert 2 b b@example.com")
+	if out := runInput(t, session, ".databases"); !strings.Contains(out, second) {
+		t.Errorf(".databases = %q, want it to name %s", out, second)
+	}
+
+	out := runInput(t, session, ".open "+filepath.Join(dir, "missing", "x.db"))
+	if !strings.HasPrefix(out, "Error:") {
+		t.Errorf(".open of a bad path printed %q, want an error", out)
+	}
+	runInput(t, session, "insert 3 c c@example.com")
+
+	if keys := fileKeys(t, first); !slices.Equal(keys, []uint32{1}) {
+		t.Errorf("%s holds %v, want [1]", first, keys)
+	}
+	if keys := fileKeys(t, second); !slices.Equal(keys, []uint32{2, 3}) {
+		t.Errorf("%s holds %v, want [2 3]", second, keys)
+	}
+}
+
+func TestOpenExistingOnly(t *testing.T) {
+	dir := t.TempDir()
+	session := openTestSession(t, filepath.Join(dir, "test.db"))
+	session.existingOnly = true
+
+	typo := filepath.Join(dir, "typo.db")
+	if out := runInput(t, session, ".open "+typo); !strings.HasPrefix(out, "Error:") {
+		t.Errorf(".open of a missing file printed %q, want an error", out)
+	}
+	if _, err := os.Stat(typo); !os.IsNotExist(err) {
+		t.Errorf(".open created %s with existingOnly set", typo)
+	}
+}
+
+func dumpOf(t *testing.T, table *Table) string {
+	t.Helper()
+	var out strings.Builder
+	if err := writeDump(&out, table); err != nil {
+		t.Fatal(err)
+	}
+	return out.String()
+}
+
+func TestGzipDumpRoundTrip(t *testing.T) {
+	dir := t.TempDir()
+	table := openTestTable(t)
+	for id := uint32(1); id <= 50; id++ {
+		insertRows(t, table, id*7%101)
+	}
+	dumpFile := filepath.Join(dir, "dump.sql.gz")
+	if out := runStatement(t, table, ".dump "+dumpFile); out != "" {
+		t.Fatalf(".dump printed %q", out)
+	}
+	data, err := os.ReadFile(dumpFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(data) < 2 || data[0] != 0x1f || data[1] != 0x8b {
+		t.Fatalf("%s is not gzip compressed", dumpFile)
+	}
+
+	var ok bool
+	out := captureOutput(t, func() {
+		ok, err = checkScript(dumpFile, DEFAULT_MAX_STATEMENT_LENGTH)
+	})
+	if err != nil || !ok {
+		t.Fatalf("checkScript: ok %v, err %v, output %q", ok, err, out)
+	}
+
+	session := openTestSession(t, filepath.Join(dir, "restored.db"))
+	out = captureOutput(t, func() {
+		err = runScript(dumpFile, session)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(out, "Error") {
+		t.Fatalf("importing the dump printed %q", out)
+	}
+	if got, want := dumpOf(t, session.table), dumpOf(t, table); got != want {
+		t.Fatalf("restored table dumps as\n%s\nwant\n%s", got, want)
+	}
+}
+
+func TestStatementTooLarge(t *testing.T) {
+	table := openTestTable(t)
+	session := newSession()
+	session.table = table
+	session.maxStatementLength = 64
+
+	// Trailing padding would pass if the line were cut and then trimmed.
+	long := "insert 1 a a@example.com" + strings.Repeat(" ", 1<<20) + "x"
+	inputBuffer := &InputBuffer{
+		reader: bufio.NewReaderSize(strings.NewReader(long+"\nselect\n"), 16),
+	}
+	if err := readInput(inputBuffer, session.maxStatementLength); err != nil {
+		t.Fatal(err)
+	}
+	if len(inputBuffer.buffer) > session.maxStatementLength+1 {
+		t.Errorf("readInput kept %d bytes of an over-long line", len(inputBuffer.buffer))
+	}
+	if inputBuffer.bufferLength != len(long) {
+		t.Errorf("bufferLength = %d, want %d", inputBuffer.bufferLength, len(long))
+	}
+	out := captureOutput(t, func() {
+		processInput(inputBuffer, session)
+	})
+	want := fmt.Sprintf("Error: statement too large (%d bytes, the limit is 64)\n", len(long))
+	if out != want {
+		t.Errorf("over-long line printed %q, want %q", out, want)
+	}
+	checkKeys(t, table, map[uint32]bool{})
+
+	if err := readInput(inputBuffer, session.maxStatementLength); err != nil {
+		t.Fatal(err)
+	}
+	if inputBuffer.buffer != "select" {
+		t.Errorf("line after the over-long one read as %q", inputBuffer.buffer)
+	}
+
+	script := filepath.Join(t.TempDir(), "script.sql")
+	if err := os.WriteFile(script, []byte(long+"\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	var err error
+	captureOutput(t, func() {
+		err = runScript(script, session)
+	})
+	if err == nil || !strings.Contains(err.Error(), "statement too large") {
+		t.Errorf("runScript on an over-long line: %v", err)
+	}
+}
+
+// poolAllocator hands out the pages in its pool, first to last.
+type poolAllocator struct {
+	pool []uint32
+}
+
+func (a *poolAllocator) allocate(pager *Pager) uint32 {
+	pageNum := a.pool[0]
+	a.pool = a.pool[1:]
+	return pageNum
+}
+
+func (a *poolAllocator) available(pager *Pager) uint32 {
+	return uint32(len(a.pool))
+}
+
+// treePages adds pageNum and every page below it to pages.
+func treePages(t *testing.T, pager *Pager, pageNum uint32, pages map[uint32]bool) {
+	t.Helper()
+	pages[pageNum] = true
+	node := mustGetPage(t, pager, pageNum)
+	if getNodeType(node) == NODE_LEAF {
+		return
+	}
+	for i := uint32(0); i <= internalNodeNumKeys(node); i++ {
+		child, err := internalNodeChild(node, i)
+		if err != nil {
+			t.Fatal(err)
+		}
+		treePages(t, pager, child, pages)
+	}
+}
+
+// Pages a merge drops are handed back to later splits, in reverse order,
+// and the table is full once the pool runs dry.
+func TestCustomAllocatorReusesDroppedPages(t *testing.T) {
+	table := openTestTable(t)
+	table.leafNodeMaxCells = 3
+	table.internalNodeMaxCells = 3
+	present := map[uint32]bool{}
+	for id := uint32(1); id <= 40; id++ {
+		insertRows(t, table, id)
+		present[id] = true
+	}
+	for id := uint32(1); id <= 30; id++ {
+		deleteRow(t, table, id)
+		delete(present, id)
+	}
+	checkTreeOK(t, table)
+
+	inUse := map[uint32]bool{}
+	treePages(t, table.pager, table.rootPageNum, inUse)
+	allocator := &poolAllocator{}
+	for pageNum := table.pager.numPages - 1; pageNum > 0; pageNum-- {
+		if !inUse[pageNum] {
+			allocator.pool = append(allocator.pool, pageNum)
+		}
+	}
+	if len(allocator.pool) < 4 {
+		t.Fatalf("only %d pages were dropped, too few to test reuse", len(allocator.pool))
+	}
+	pool := slices.Clone(allocator.pool)
+	table.pager.allocator = allocator
+	numPages := table.pager.numPages
+
+	var id uint32
+	for id = 100; ; id++ {
+		result := insertRow(t, table, id)
+		if result == EXECUTE_TABLE_FULL {
+			break
+		}
+		if result != EXECUTE_SUCCESS {
+			t.Fatalf("insert %d: result %d", id, result)
+		}
+		present[id] = true
+		checkTreeOK(t, table)
+	}
+	if plan := explainInsertOf(t, table, id); plan.newPages <= uint32(len(allocator.pool)) {
+		t.Fatalf("insert %d refused with %d pages left, it needs %d", id, len(allocator.pool), plan.newPages)
+	}
+	if table.pager.numPages != numPages {
+		t.Fatalf("numPages grew from %d to %d, so a page came from past the file", numPages, table.pager.numPages)
+	}
+	checkTreeOK(t, table)
+	checkKeys(t, table, present)
+
+	inUse = map[uint32]bool{}
+	treePages(t, table.pager, table.rootPageNum, inUse)
+	used := pool[:len(pool)-len(allocator.pool)]
+	for _, pageNum := range used {
+		if !inUse[pageNum] {
+			t.Errorf("page %d was allocated but is not in the tree", pageNum)
+		}
+	}
+}
+
+func TestSeed(t *testing.T) {
+	session := openTestSession(t, filepath.Join(t.TempDir(), "test.db"))
+	insertRows(t, session.table, 7)
+
+	out := runInput(t, session, ".seed 500")
+	if !strings.HasPrefix(out, "seeded 499 rows in ") || !strings.HasSuffix(out, ", 1 ids already existed\n") {
+		t.Fatalf(".seed 500 printed %q", out)
+	}
+	if out := runInput(t, session, ".check"); out != "Tree OK.\n" {
+		t.Fatalf(".check printed %q", out)
+	}
+	want := map[uint32]bool{}
+	for id := uint32(1); id <= 500; id++ {
+		want[id] = true
+	}
+	checkKeys(t, session.table, want)
+}
+
+// Seeding or fast-loading past what the pager holds stops at a full table
+// instead of corrupting it.
+func TestSeedAndFastloadStopWhenFull(t *testing.T) {
+	session := openTestSession(t, filepath.Join(t.TempDir(), "test.db"))
+	out := runInput(t, session, ".seed 100000")
+	if !strings.HasPrefix(out, "Error: table full after ") {
+		t.Fatalf(".seed past capacity printed %q", out)
+	}
+	if out := runInput(t, session, ".check"); out != "Tree OK.\n" {
+		t.Fatalf(".check after a full .seed printed %q", out)
+	}
+
+	session = openTestSession(t, filepath.Join(t.TempDir(), "test.db"))
+	runInput(t, session, ".fastload on")
+	var result string
+	for id := 1; ; id++ {
+		result = runInput(t, session, fmt.Sprintf("insert %d u%d u%d@example.com", id, id, id))
+		if result != "executed.\n" {
+			break
+		}
+	}
+	if result != "Error:Table full\n" {
+		t.Fatalf("fastload past capacity printed %q", result)
+	}
+	checkTreeOK(t, session.table)
+}
+
+func TestThreeLevelTree(t *testing.T) {
+	table := openTestTable(t)
+	table.leafNodeMaxCells = 3
+	table.internalNodeMaxCells = 3
+	present := map[uint32]bool{}
+	for id := uint32(1); treeHeight(t, table) < 3; id++ {
+		insertRows(t, table, id*37%1009)
+		present[id*37%1009] = true
+	}
+	if out := runStatement(t, table, ".check"); out != "Tree OK.\n" {
+		t.Fatalf(".check on a three-level tree printed %q", out)
+	}
+	checkKeys(t, table, present)
+}
+
+// The root page of a database from before the root flag was set on it
+// reads as a non-root leaf whose cells overlap its next-leaf pointer.
+// TestOpenUpgradesOldFormat opens testdata/old_format.db, five rows written
+// by the version before the root page was flagged, whose leaf cells start
+// where the next-leaf field now sits.
+func TestOpenUpgradesOldFormat(t *testing.T) {
+	old, err := os.ReadFile(filepath.Join("testdata", "old_format.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	filename := filepath.Join(t.TempDir(), "old.db")
+	if err := os.WriteFile(filename, old, 0600); err != nil {
+		t.Fatal(err)
+	}
+	table, err := dbOpen(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "(1 alice alice@example.com)\n(2 bob bob@example.com)\n(3 carol carol@example.com)\n" +
+		"(4 dave dave@example.com)\n(5 erin erin@example.com)\nexecuted.\n"
+	if out := runStatement(t, table, "select"); out != want {
+		t.Fatalf("select on the upgraded file printed %q, want %q", out, want)
+	}
+	/* Enough rows to split the upgraded root */
+	ids := map[uint32]bool{1: true, 2: true, 3: true, 4: true, 5: true}
+	for id := uint32(6); id <= 30; id++ {
+		insertRows(t, table, id)
+		ids[id] = true
+	}
+	checkTreeOK(t, table)
+	if err := dbClose(table); err != nil {
+		t.Fatal(err)
+	}
+
+	table, err = dbOpen(filename)
+	if err != nil {
+		t.Fatalf("reopening the upgraded file: %v", err)
+	}
+	defer dbClose(table)
+	checkTreeOK(t, table)
+	checkKeys(t, table, ids)
+}
+
+func TestOpenRejectsUnflaggedInternalRoot(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "bad.db")
+	page := make([]byte, PAGE_SIZE)
+	initializeInternalNode(page)
+	if err := os.WriteFile(filename, page, 0600); err != nil {
+		t.Fatal(err)
+	}
+	table, err := dbOpen(filename)
+	if err == nil {
+		dbClose(table)
+		t.Fatal("dbOpen accepted an internal root page without the root flag")
+	}
+	if !strings.Contains(err.Error(), "older page format") {
+		t.Fatalf("dbOpen: %v, want an older page format error", err)
+	}
+	if _, ok := openPagers[filename]; ok {
+		t.Fatal("the rejected file's pager is still open")
+	}
+}
+
+// TestOnDiskLayout compares a small database file byte for byte with
+// testdata/layout.golden, so any change to the page format fails here
+// until the golden file is regenerated with -update.
+func TestOnDiskLayout(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "layout.db")
+	table, err := dbOpen(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	table.leafNodeMaxCells = 3
+	table.internalNodeMaxCells = 3
+	insertRows(t, table, 5, 1, 9, 3, 7, 2, 8, 4, 6, 10)
+	if err := dbClose(table); err != nil {
+		t.Fatal(err)
+	}
+	got, err := os.ReadFile(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	golden := filepath.Join("testdata", "layout.golden")
+	if *update {
+		if err := os.WriteFile(golden, got, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	want, err := os.ReadFile(golden)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != len(want) {
+		t.Fatalf("database file is %d bytes, golden file is %d", len(got), len(want))
+	}
+	for i := range got {
+		if got[i] != want[i] {
+			t.Fatalf("database file differs from %s at byte %d (page %d, offset %d): %#02x, want %#02x",
+				golden, i, i/PAGE_SIZE, i%PAGE_SIZE, got[i], want[i])
+		}
+	}
+}
+
+func TestReopenKeepsRows(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "test.db")
+	table, err := dbOpen(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	present := map[uint32]bool{}
+	for id := uint32(1); id <= 40; id++ {
+		insertRows(t, table, id)
+		present[id] = true
+	}
+	if err := dbClose(table); err != nil {
+		t.Fatal(err)
+	}
+
+	table, err = dbOpen(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dbClose(table)
+	checkTreeOK(t, table)
+	checkKeys(t, table, present)
+}
+
+func TestPagerReadsPartialLastPage(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "partial.db")
+	data := make([]byte, PAGE_SIZE+100)
+	for i := range data {
+		data[i] = byte(i)
+	}
+	if err := os.WriteFile(filename, data, 0600); err != nil {
+		t.Fatal(err)
+	}
+	pager, err := pagerOpen(filename, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pager.file.Close()
+	if pager.numPages != 2 {
+		t.Fatalf("numPages = %d, want 2", pager.numPages)
+	}
+	page := mustGetPage(t, pager, 1)
+	if !bytes.Equal(page[:100], data[PAGE_SIZE:]) {
+		t.Fatal("the partial last page was not read from the file")
+	}
+	if !bytes.Equal(page[100:], make([]byte, PAGE_SIZE-100)) {
+		t.Fatal("the rest of the partial last page is not zero")
+	}
+}
+
+func TestPagerErrorsAreReturned(t *testing.T) {
+	table := openTestTable(t)
+	if _, err := getPage(table.pager, TABLE_MAX_PAGES); err == nil {
+		t.Fatal("getPage past TABLE_MAX_PAGES returned no error")
+	}
+
+	// A root whose child points past the last page makes lookups fail
+	// with an error instead of exiting the process.
+	table.leafNodeMaxCells = 3
+	insertRows(t, table, 1, 2, 3, 4)
+	root := mustGetPage(t, table.pager, table.rootPageNum)
+	rightChild := internalNodeRightChild(root)
+	setInternalNodeRightChild(root, TABLE_MAX_PAGES+5)
+	if _, err := tableFind(table, 4); err == nil {
+		t.Fatal("tableFind through a corrupt child pointer returned no error")
+	}
+	if result, err := executeInsert(&Statement{typ: STATEMENT_INSERT, rowToInsert: Row{id: 9}}, table); err == nil {
+		t.Fatalf("insert through a corrupt child pointer returned result %d and no error", result)
+	}
+	if out := runStatement(t, table, "select where id = 4"); !strings.HasPrefix(out, "Error: ") {
+		t.Fatalf("select through a corrupt child pointer printed %q", out)
+	}
+	setInternalNodeRightChild(root, rightChild)
+}